@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const adminConfigPath = "/config"
+
+type adminHandler struct {
+	handler  *httpHandler
+	listener *limitListener
+
+	authHeaderMust []byte
+}
+
+type adminState struct {
+	Concurrency int    `json:"concurrency"`
+	Processing  int    `json:"processing"`
+	Queued      int    `json:"queued"`
+	MaxQueue    int    `json:"max_queue"`
+	MaxClients  int    `json:"max_clients"`
+	Clients     int    `json:"clients"`
+	LogLevel    string `json:"log_level"`
+}
+
+// adminConfigUpdate contains only the fields that should be changed
+type adminConfigUpdate struct {
+	Concurrency *int    `json:"concurrency"`
+	MaxQueue    *int    `json:"max_queue"`
+	MaxClients  *int    `json:"max_clients"`
+	LogLevel    *string `json:"log_level"`
+}
+
+func startAdminServer(handler *httpHandler, listener *limitListener) *http.Server {
+	s := &http.Server{
+		Addr: conf.AdminBind,
+		Handler: &adminHandler{
+			handler:        handler,
+			listener:       listener,
+			authHeaderMust: []byte(fmt.Sprintf("Bearer %s", conf.AdminSecret)),
+		},
+		ReadTimeout:    time.Duration(conf.ReadTimeout) * time.Second,
+		WriteTimeout:   time.Duration(conf.WriteTimeout) * time.Second,
+		MaxHeaderBytes: 1 << 20,
+	}
+
+	go func() {
+		log.Printf("Starting admin server at %s\n", s.Addr)
+		if err := s.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalln(err)
+		}
+	}()
+
+	return s
+}
+
+func (h *adminHandler) state() adminState {
+	concurrency, processing, queued := h.handler.sem.stats()
+	maxClients, clients, _ := h.listener.sem.stats()
+
+	return adminState{
+		Concurrency: concurrency,
+		Processing:  processing,
+		Queued:      queued,
+		MaxQueue:    h.handler.sem.queueLimit(),
+		MaxClients:  maxClients,
+		Clients:     clients,
+		LogLevel:    getLogLevel(),
+	}
+}
+
+func (h *adminHandler) update(upd *adminConfigUpdate) ([]string, error) {
+	// Validate everything first to not apply the update partially
+	if upd.Concurrency != nil && *upd.Concurrency <= 0 {
+		return nil, fmt.Errorf("Concurrency should be greater than 0, now - %d", *upd.Concurrency)
+	}
+
+	if upd.MaxQueue != nil && *upd.MaxQueue < 0 {
+		return nil, fmt.Errorf("Max queue should be greater than or equal to 0, now - %d", *upd.MaxQueue)
+	}
+
+	if upd.MaxClients != nil && *upd.MaxClients <= 0 {
+		return nil, fmt.Errorf("Max clients should be greater than 0, now - %d", *upd.MaxClients)
+	}
+
+	if upd.LogLevel != nil {
+		if _, ok := logLevelNames[*upd.LogLevel]; !ok {
+			return nil, fmt.Errorf("Invalid log level: %s", *upd.LogLevel)
+		}
+	}
+
+	old := h.state()
+
+	var changes []string
+
+	if upd.Concurrency != nil {
+		h.handler.sem.resize(*upd.Concurrency)
+		changes = append(changes, fmt.Sprintf("concurrency: %d -> %d", old.Concurrency, *upd.Concurrency))
+	}
+
+	if upd.MaxQueue != nil {
+		h.handler.sem.resizeQueue(*upd.MaxQueue)
+		changes = append(changes, fmt.Sprintf("max_queue: %d -> %d", old.MaxQueue, *upd.MaxQueue))
+	}
+
+	if upd.MaxClients != nil {
+		h.listener.sem.resize(*upd.MaxClients)
+		changes = append(changes, fmt.Sprintf("max_clients: %d -> %d", old.MaxClients, *upd.MaxClients))
+	}
+
+	if upd.LogLevel != nil {
+		setLogLevel(*upd.LogLevel)
+		changes = append(changes, fmt.Sprintf("log_level: %s -> %s", old.LogLevel, *upd.LogLevel))
+	}
+
+	return changes, nil
+}
+
+func (h *adminHandler) respondWithState(rw http.ResponseWriter) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(200)
+	json.NewEncoder(rw).Encode(h.state())
+}
+
+func (h *adminHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), h.authHeaderMust) != 1 {
+		if auditLogEnabled {
+			logAuditEvent(context.Background(), r, auditEventSecretMismatch, "Invalid admin secret")
+		}
+
+		http.Error(rw, "Forbidden", 403)
+		return
+	}
+
+	if r.URL.Path != adminConfigPath {
+		http.NotFound(rw, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		h.respondWithState(rw)
+	case http.MethodPut, http.MethodPatch:
+		var upd adminConfigUpdate
+
+		if err := json.NewDecoder(r.Body).Decode(&upd); err != nil {
+			http.Error(rw, fmt.Sprintf("Invalid config: %s", err), 400)
+			return
+		}
+
+		changes, err := h.update(&upd)
+		if err != nil {
+			http.Error(rw, err.Error(), 422)
+			return
+		}
+
+		if len(changes) > 0 {
+			msg := strings.Join(changes, "; ")
+
+			log.Printf("Runtime config changed: %s\n", msg)
+
+			if auditLogEnabled {
+				logAuditEvent(context.Background(), r, auditEventAdminConfigChange, msg)
+			}
+		}
+
+		h.respondWithState(rw)
+	default:
+		rw.Header().Set("Allow", "GET, PUT, PATCH")
+		http.Error(rw, "Method not allowed", 405)
+	}
+}
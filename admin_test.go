@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type AdminTestSuite struct {
+	MainTestSuite
+
+	admin *adminHandler
+}
+
+func (s *AdminTestSuite) SetupTest() {
+	s.MainTestSuite.SetupTest()
+
+	conf.Concurrency = 4
+	conf.MaxClients = 40
+
+	s.admin = &adminHandler{
+		handler:        newHTTPHandler(),
+		listener:       newLimitListener(nil, conf.MaxClients),
+		authHeaderMust: []byte("Bearer test-secret"),
+	}
+}
+
+func (s *AdminTestSuite) TearDownTest() {
+	setLogLevel("info")
+
+	s.MainTestSuite.TearDownTest()
+}
+
+func (s *AdminTestSuite) request(method, body, secret string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "http://localhost/config", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+secret)
+
+	rw := httptest.NewRecorder()
+	s.admin.ServeHTTP(rw, req)
+
+	return rw
+}
+
+func (s *AdminTestSuite) state(rw *httptest.ResponseRecorder) adminState {
+	var state adminState
+
+	require.Nil(s.T(), json.Unmarshal(rw.Body.Bytes(), &state))
+
+	return state
+}
+
+func (s *AdminTestSuite) TestUnauthorized() {
+	rw := s.request("GET", "", "wrong-secret")
+
+	assert.Equal(s.T(), 403, rw.Code)
+}
+
+func (s *AdminTestSuite) TestGetConfig() {
+	rw := s.request("GET", "", "test-secret")
+
+	require.Equal(s.T(), 200, rw.Code)
+
+	state := s.state(rw)
+	assert.Equal(s.T(), 4, state.Concurrency)
+	assert.Equal(s.T(), 40, state.MaxClients)
+	assert.Equal(s.T(), "info", state.LogLevel)
+}
+
+func (s *AdminTestSuite) TestUpdateConfig() {
+	rw := s.request("PUT", `{"concurrency":8,"log_level":"error"}`, "test-secret")
+
+	require.Equal(s.T(), 200, rw.Code)
+
+	state := s.state(rw)
+	assert.Equal(s.T(), 8, state.Concurrency)
+	assert.Equal(s.T(), 40, state.MaxClients)
+	assert.Equal(s.T(), "error", state.LogLevel)
+
+	// Config itself shouldn't be changed since it's used for ETag calculation
+	assert.Equal(s.T(), 4, conf.Concurrency)
+}
+
+func (s *AdminTestSuite) TestUpdateMaxQueue() {
+	rw := s.request("PATCH", `{"max_queue":10}`, "test-secret")
+
+	require.Equal(s.T(), 200, rw.Code)
+
+	assert.Equal(s.T(), 10, s.state(rw).MaxQueue)
+	assert.Equal(s.T(), 10, s.admin.handler.sem.queueLimit())
+}
+
+func (s *AdminTestSuite) TestUpdateConfigInvalid() {
+	rw := s.request("PATCH", `{"concurrency":8,"max_clients":0}`, "test-secret")
+
+	assert.Equal(s.T(), 422, rw.Code)
+
+	size, _, _ := s.admin.handler.sem.stats()
+	assert.Equal(s.T(), 4, size)
+
+	rw = s.request("PATCH", `{"max_queue":-1}`, "test-secret")
+	assert.Equal(s.T(), 422, rw.Code)
+
+	rw = s.request("PATCH", `{"log_level":"verbose"}`, "test-secret")
+	assert.Equal(s.T(), 422, rw.Code)
+
+	rw = s.request("PATCH", `{"concurrency":`, "test-secret")
+	assert.Equal(s.T(), 400, rw.Code)
+}
+
+func (s *AdminTestSuite) TestMethodNotAllowed() {
+	rw := s.request("DELETE", "", "test-secret")
+
+	assert.Equal(s.T(), 405, rw.Code)
+}
+
+func (s *AdminTestSuite) TestLimitListener() {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(s.T(), err)
+
+	ll := newLimitListener(l, 1)
+	defer ll.Close()
+
+	go func() {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err == nil {
+			c.Close()
+		}
+	}()
+
+	c, err := ll.Accept()
+	require.Nil(s.T(), err)
+
+	_, used, _ := ll.sem.stats()
+	assert.Equal(s.T(), 1, used)
+
+	c.Close()
+	c.Close()
+
+	_, used, _ = ll.sem.stats()
+	assert.Equal(s.T(), 0, used)
+}
+
+func (s *AdminTestSuite) TestStartAdminServer() {
+	conf.AdminBind = "127.0.0.1:0"
+	conf.ReadTimeout = 3
+	conf.WriteTimeout = 4
+
+	srv := startAdminServer(s.admin.handler, s.admin.listener)
+
+	assert.Equal(s.T(), 3*time.Second, srv.ReadTimeout)
+	assert.Equal(s.T(), 4*time.Second, srv.WriteTimeout)
+
+	assert.Nil(s.T(), srv.Shutdown(context.Background()))
+}
+
+func TestAdmin(t *testing.T) {
+	suite.Run(t, new(AdminTestSuite))
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	auditEventSignatureFailure = "signature_failure"
+	auditEventSecretMismatch   = "secret_mismatch"
+
+	auditEventAdminConfigChange = "admin_config_change"
+)
+
+var (
+	auditLogEnabled = false
+
+	auditLogMutex   sync.Mutex
+	auditLogEncoder *json.Encoder
+)
+
+type auditLogRecord struct {
+	Time         string `json:"time"`
+	Event        string `json:"event"`
+	RequestID    string `json:"request_id,omitempty"`
+	RemoteAddr   string `json:"remote_addr,omitempty"`
+	ForwardedFor string `json:"forwarded_for,omitempty"`
+	UserAgent    string `json:"user_agent,omitempty"`
+	Method       string `json:"method,omitempty"`
+	Path         string `json:"path,omitempty"`
+	Message      string `json:"message,omitempty"`
+}
+
+func initAuditLog() {
+	if len(conf.AuditLogPath) == 0 {
+		return
+	}
+
+	f, err := os.OpenFile(conf.AuditLogPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		log.Fatalf("Can't open audit log: %s", err)
+	}
+
+	setAuditLogOutput(f)
+
+	auditLogEnabled = true
+}
+
+func setAuditLogOutput(w io.Writer) {
+	auditLogMutex.Lock()
+	defer auditLogMutex.Unlock()
+
+	auditLogEncoder = json.NewEncoder(w)
+	auditLogEncoder.SetEscapeHTML(false)
+}
+
+// logAuditEvent writes the event to the audit log as a single JSON line.
+// Request can be nil for the events that are not caused by an HTTP request
+func logAuditEvent(ctx context.Context, r *http.Request, event, message string) {
+	rec := auditLogRecord{
+		Time:    time.Now().Format(time.RFC3339),
+		Event:   event,
+		Message: message,
+	}
+
+	rec.RequestID, _ = ctx.Value(requestIDCtxKey).(string)
+
+	if r != nil {
+		rec.RemoteAddr = r.RemoteAddr
+		rec.ForwardedFor = r.Header.Get("X-Forwarded-For")
+		rec.UserAgent = r.Header.Get("User-Agent")
+		rec.Method = r.Method
+		rec.Path = redactRequestURI(r.URL.RequestURI())
+	}
+
+	auditLogMutex.Lock()
+	defer auditLogMutex.Unlock()
+
+	if err := auditLogEncoder.Encode(rec); err != nil {
+		warning("Can't write to audit log: %s", err)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type AuditLogTestSuite struct {
+	MainTestSuite
+
+	buf *bytes.Buffer
+}
+
+func (s *AuditLogTestSuite) SetupTest() {
+	s.MainTestSuite.SetupTest()
+
+	s.buf = new(bytes.Buffer)
+	setAuditLogOutput(s.buf)
+	auditLogEnabled = true
+}
+
+func (s *AuditLogTestSuite) TearDownTest() {
+	auditLogEnabled = false
+
+	s.MainTestSuite.TearDownTest()
+}
+
+func (s *AuditLogTestSuite) lastRecord() map[string]string {
+	var rec map[string]string
+
+	require.Nil(s.T(), json.Unmarshal(s.buf.Bytes(), &rec))
+
+	return rec
+}
+
+func (s *AuditLogTestSuite) TestLogEvent() {
+	req, _ := http.NewRequest("GET", "http://example.com/unsafe/plain/http://images.dev/lorem/ipsum.jpg", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "192.168.0.1")
+
+	ctx := context.WithValue(context.Background(), requestIDCtxKey, "test-id")
+
+	logAuditEvent(ctx, req, auditEventSecretMismatch, "Invalid secret")
+
+	rec := s.lastRecord()
+
+	assert.Equal(s.T(), "secret_mismatch", rec["event"])
+	assert.Equal(s.T(), "test-id", rec["request_id"])
+	assert.Equal(s.T(), "10.0.0.1:1234", rec["remote_addr"])
+	assert.Equal(s.T(), "192.168.0.1", rec["forwarded_for"])
+	assert.Equal(s.T(), "/unsafe/plain/http://images.dev/lorem/ipsum.jpg", rec["path"])
+	assert.Equal(s.T(), "Invalid secret", rec["message"])
+}
+
+func (s *AuditLogTestSuite) TestLogSignatureFailure() {
+	conf.Keys = []securityKey{securityKey("test-key")}
+	conf.Salts = []securityKey{securityKey("test-salt")}
+	conf.AllowInsecure = false
+
+	req, _ := http.NewRequest("GET", "http://example.com/dtLwhdnPPiu_epMl1LrzheLpvHas-4mwvY6L3Z8WwlY/plain/http://images.dev/lorem/ipsum.jpg", nil)
+
+	_, err := parsePath(context.Background(), req)
+	require.Error(s.T(), err)
+
+	rec := s.lastRecord()
+
+	assert.Equal(s.T(), "signature_failure", rec["event"])
+	assert.Equal(s.T(), "Invalid signature", rec["message"])
+}
+
+func TestAuditLog(t *testing.T) {
+	suite.Run(t, new(AuditLogTestSuite))
+}
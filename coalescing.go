@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type processingResult struct {
+	data    []byte
+	imgtype imageType
+	eTag    string
+	// Path of the result in the result cache, empty if the result is not cached
+	cachePath string
+}
+
+// coalescingCall is the processing shared between the requests with the same key
+type coalescingCall struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	res *processingResult
+	err error
+
+	waiters int
+}
+
+var (
+	coalescingMutex sync.Mutex
+	coalescingCalls = make(map[string]*coalescingCall)
+)
+
+// newCoalescingCtx creates the context for the processing shared between requests.
+// It doesn't depend on any of the requests: requests can join the processing later
+// and time out at different moments, so it has its own deadline. Processing changes
+// processing options, so it also gets its own copy of them
+func newCoalescingCtx(imageURL string, po processingOptions) (context.Context, context.CancelFunc) {
+	ctx := context.WithValue(context.Background(), imageURLCtxKey, imageURL)
+	ctx = context.WithValue(ctx, processingOptionsCtxKey, &po)
+
+	return startTimer(ctx, time.Duration(conf.MaxRequestTimeout)*time.Second)
+}
+
+// coalesceProcessing runs fn once for all the concurrent requests with the same key
+// and shares its result between them. Each request waits for the result only until
+// its own deadline. When the last request leaves, the processing is canceled, so it doesn't
+// keep running when no one holds a processing slot for it
+func coalesceProcessing(ctx context.Context, key string, fn func(ctx context.Context) *processingResult) *processingResult {
+	c := joinCoalescingCall(ctx, key, fn)
+	defer leaveCoalescingCall(key, c)
+
+	select {
+	case <-c.done:
+		if c.err != nil {
+			panic(c.err)
+		}
+
+		return c.res
+	case <-ctx.Done():
+		checkTimeout(ctx)
+	}
+
+	return nil
+}
+
+func joinCoalescingCall(ctx context.Context, key string, fn func(ctx context.Context) *processingResult) *coalescingCall {
+	coalescingMutex.Lock()
+	defer coalescingMutex.Unlock()
+
+	// Processing that has timed out or has been canceled is doomed,
+	// so new requests shouldn't join it and start their own processing instead
+	if c, ok := coalescingCalls[key]; ok && c.ctx.Err() == nil {
+		c.waiters++
+		return c
+	}
+
+	sctx, cancel := newCoalescingCtx(getImageURL(ctx), *getProcessingOptions(ctx))
+
+	c := &coalescingCall{
+		ctx:     sctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		waiters: 1,
+	}
+
+	coalescingCalls[key] = c
+
+	go runCoalescingCall(key, c, fn)
+
+	return c
+}
+
+func leaveCoalescingCall(key string, c *coalescingCall) {
+	coalescingMutex.Lock()
+	defer coalescingMutex.Unlock()
+
+	c.waiters--
+
+	if c.waiters == 0 {
+		c.cancel()
+
+		if coalescingCalls[key] == c {
+			delete(coalescingCalls, key)
+		}
+	}
+}
+
+// runCoalescingCall runs fn and stores the result in the call. fn reports errors
+// by panicking as the rest of the request handling does, so we recover here
+// to not leave the requests waiting forever
+func runCoalescingCall(key string, c *coalescingCall, fn func(ctx context.Context) *processingResult) {
+	defer func() {
+		if rerr := recover(); rerr != nil {
+			if err, ok := rerr.(error); ok {
+				c.err = err
+			} else {
+				c.err = fmt.Errorf("%v", rerr)
+			}
+		}
+
+		coalescingMutex.Lock()
+		if coalescingCalls[key] == c {
+			delete(coalescingCalls, key)
+		}
+		coalescingMutex.Unlock()
+
+		c.cancel()
+		close(c.done)
+	}()
+
+	c.res = fn(c.ctx)
+}
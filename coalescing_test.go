@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type CoalescingTestSuite struct{ MainTestSuite }
+
+func (s *CoalescingTestSuite) ctx(timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx := context.WithValue(context.Background(), imageURLCtxKey, "http://images.dev/lorem/ipsum.jpg")
+	ctx = context.WithValue(ctx, processingOptionsCtxKey, &processingOptions{})
+
+	return startTimer(ctx, timeout)
+}
+
+func (s *CoalescingTestSuite) TestCoalesce() {
+	var calls int32
+
+	release := make(chan struct{})
+	results := make([]*processingResult, 5)
+
+	var wg sync.WaitGroup
+
+	for i := range results {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			ctx, cancel := s.ctx(time.Second)
+			defer cancel()
+
+			results[i] = coalesceProcessing(ctx, "test", func(ctx context.Context) *processingResult {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return &processingResult{data: []byte("test"), imgtype: imageTypePNG}
+			})
+		}(i)
+	}
+
+	// Give all the goroutines time to join the call
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(s.T(), int32(1), atomic.LoadInt32(&calls))
+
+	for _, res := range results {
+		require.NotNil(s.T(), res)
+		assert.Equal(s.T(), []byte("test"), res.data)
+		assert.Equal(s.T(), imageTypePNG, res.imgtype)
+	}
+}
+
+func (s *CoalescingTestSuite) TestCoalesceError() {
+	err := newError(404, "Not found", "Not found")
+
+	ctx, cancel := s.ctx(time.Second)
+	defer cancel()
+
+	assert.PanicsWithValue(s.T(), err, func() {
+		coalesceProcessing(ctx, "test", func(ctx context.Context) *processingResult {
+			panic(err)
+		})
+	})
+}
+
+func (s *CoalescingTestSuite) TestCoalesceNotErrorPanic() {
+	ctx, cancel := s.ctx(time.Second)
+	defer cancel()
+
+	defer func() {
+		err, ok := recover().(error)
+
+		require.True(s.T(), ok)
+		assert.Equal(s.T(), "test", err.Error())
+	}()
+
+	coalesceProcessing(ctx, "test", func(ctx context.Context) *processingResult {
+		panic("test")
+	})
+}
+
+func (s *CoalescingTestSuite) TestCoalesceTimeout() {
+	release := make(chan struct{})
+	defer close(release)
+
+	ctx, cancel := s.ctx(10 * time.Millisecond)
+	defer cancel()
+
+	assert.Panics(s.T(), func() {
+		coalesceProcessing(ctx, "test-timeout", func(ctx context.Context) *processingResult {
+			<-release
+			return &processingResult{}
+		})
+	})
+}
+
+func (s *CoalescingTestSuite) TestCoalesceLeaderTimeout() {
+	release := make(chan struct{})
+	leaderDone := make(chan struct{})
+
+	fn := func(ctx context.Context) *processingResult {
+		<-release
+		checkTimeout(ctx)
+		return &processingResult{data: []byte("test"), imgtype: imageTypePNG}
+	}
+
+	go func() {
+		defer close(leaderDone)
+
+		ctx, cancel := s.ctx(20 * time.Millisecond)
+		defer cancel()
+
+		defer func() {
+			err, ok := recover().(*imgproxyError)
+
+			require.True(s.T(), ok)
+			assert.Equal(s.T(), 503, err.StatusCode)
+		}()
+
+		coalesceProcessing(ctx, "test-leader-timeout", fn)
+	}()
+
+	// Let the leader start the processing
+	time.Sleep(5 * time.Millisecond)
+
+	followerRes := make(chan *processingResult)
+
+	go func() {
+		ctx, cancel := s.ctx(time.Second)
+		defer cancel()
+
+		followerRes <- coalesceProcessing(ctx, "test-leader-timeout", fn)
+	}()
+
+	<-leaderDone
+	close(release)
+
+	res := <-followerRes
+
+	require.NotNil(s.T(), res)
+	assert.Equal(s.T(), []byte("test"), res.data)
+}
+
+func (s *CoalescingTestSuite) TestCoalesceProcessingOptionsCopy() {
+	ctx, cancel := s.ctx(time.Second)
+	defer cancel()
+
+	coalesceProcessing(ctx, "test-po-copy", func(sctx context.Context) *processingResult {
+		getProcessingOptions(sctx).Format = imageTypePNG
+		return &processingResult{imgtype: imageTypePNG}
+	})
+
+	assert.Equal(s.T(), imageTypeUnknown, getProcessingOptions(ctx).Format)
+}
+
+func (s *CoalescingTestSuite) TestCoalesceDontJoinTimedOut() {
+	conf.MaxRequestTimeout = 1
+
+	var calls int32
+
+	release := make(chan struct{})
+	defer close(release)
+
+	fn := func(ctx context.Context) *processingResult {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			<-release
+		}
+		return &processingResult{}
+	}
+
+	go func() {
+		ctx, cancel := s.ctx(5 * time.Second)
+		defer cancel()
+
+		coalesceProcessing(ctx, "test-forget", fn)
+	}()
+
+	// Wait for the shared processing to time out
+	time.Sleep(1100 * time.Millisecond)
+
+	ctx, cancel := s.ctx(time.Second)
+	defer cancel()
+
+	require.NotNil(s.T(), coalesceProcessing(ctx, "test-forget", fn))
+	assert.Equal(s.T(), int32(2), atomic.LoadInt32(&calls))
+}
+
+func (s *CoalescingTestSuite) TestCoalesceCancelWhenAllLeft() {
+	canceled := make(chan struct{})
+
+	fn := func(ctx context.Context) *processingResult {
+		<-ctx.Done()
+		close(canceled)
+		return &processingResult{}
+	}
+
+	ctx, cancel := s.ctx(20 * time.Millisecond)
+	defer cancel()
+
+	assert.Panics(s.T(), func() {
+		coalesceProcessing(ctx, "test-cancel", fn)
+	})
+
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		s.T().Fatal("Shared processing should be canceled when all the requests have left")
+	}
+}
+
+func (s *CoalescingTestSuite) TestCoalesceStoreResultOnce() {
+	dir, err := ioutil.TempDir("", "imgproxy-coalescing")
+	require.Nil(s.T(), err)
+	defer os.RemoveAll(dir)
+
+	conf.ResultCachePath = dir
+
+	var stores int32
+
+	release := make(chan struct{})
+	results := make([]*processingResult, 3)
+
+	var wg sync.WaitGroup
+
+	for i := range results {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			ctx, cancel := s.ctx(time.Second)
+			defer cancel()
+
+			results[i] = coalesceProcessing(ctx, "abcd", func(ctx context.Context) *processingResult {
+				<-release
+				res := &processingResult{data: []byte("test"), imgtype: imageTypePNG}
+				storeResult("abcd", res)
+				atomic.AddInt32(&stores, 1)
+				return res
+			})
+		}(i)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(s.T(), int32(1), atomic.LoadInt32(&stores))
+
+	for _, res := range results {
+		assert.Equal(s.T(), cachedResultPath("abcd", imageTypePNG), res.cachePath)
+	}
+}
+
+func TestCoalescing(t *testing.T) {
+	suite.Run(t, new(CoalescingTestSuite))
+}
@@ -6,7 +6,10 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
@@ -43,6 +46,29 @@ func boolEnvConfig(b *bool, name string) {
 	}
 }
 
+func strSliceEnvConfig(s *[]string, name string) {
+	if env := os.Getenv(name); len(env) > 0 {
+		parts := strings.Split(env, ",")
+
+		for i, part := range parts {
+			parts[i] = strings.TrimSpace(part)
+		}
+
+		*s = parts
+	}
+}
+
+func processingOptionsNamesConfig(names []string, name string) {
+	for i, n := range names {
+		fullName, ok := processingOptionsNames[n]
+		if !ok {
+			log.Fatalf("%s contains unknown processing option: %s\n", name, n)
+		}
+
+		names[i] = fullName
+	}
+}
+
 func hexEnvConfig(b *[]securityKey, name string) {
 	var err error
 
@@ -129,15 +155,65 @@ func presetFileConfig(p presets, filepath string) {
 	}
 }
 
+func sourceHostsEnvConfig(h sourceHosts, name string) {
+	if env := os.Getenv(name); len(env) > 0 {
+		hostStrings := strings.Split(env, ",")
+
+		for _, hostStr := range hostStrings {
+			if err := parseSourceHost(h, hostStr); err != nil {
+				log.Fatalln(err)
+			}
+		}
+	}
+}
+
+func sourceHostsFileConfig(h sourceHosts, filepath string) {
+	if len(filepath) == 0 {
+		return
+	}
+
+	f, err := os.Open(filepath)
+	if err != nil {
+		log.Fatalf("Can't open file %s\n", filepath)
+	}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if err := parseSourceHost(h, scanner.Text()); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("Failed to read source hosts file: %s", err)
+	}
+}
+
+func namedStringsEnvConfig(m map[string]string, name string) {
+	if env := os.Getenv(name); len(env) > 0 {
+		for _, def := range strings.Split(env, ",") {
+			parts := strings.SplitN(def, "=", 2)
+
+			if len(parts) != 2 || len(strings.TrimSpace(parts[0])) == 0 || len(strings.TrimSpace(parts[1])) == 0 {
+				log.Fatalf("Invalid definition in %s: %s\n", name, def)
+			}
+
+			m[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	}
+}
+
 type config struct {
-	Bind            string
-	ReadTimeout     int
-	WaitTimeout     int
-	WriteTimeout    int
-	DownloadTimeout int
-	Concurrency     int
-	MaxClients      int
-	TTL             int
+	Bind              string
+	ReadTimeout       int
+	WaitTimeout       int
+	WriteTimeout      int
+	MaxRequestTimeout int
+	DownloadTimeout   int
+	Concurrency       int
+	MaxClients        int
+	MaxQueue          int
+	TTL               int
 
 	MaxSrcDimension  int
 	MaxSrcResolution int
@@ -165,7 +241,16 @@ type config struct {
 
 	IgnoreSslVerification bool
 
+	RejectSourceTypeMismatch bool
+	ForbidPolyglots          bool
+
 	LocalFileSystemRoot string
+	AllowDataURLs       bool
+	MaxDataURLSize      int
+	WebDAVServers       map[string]string
+	SFTPServers         map[string]string
+	SFTPKeys            map[string]string
+	SFTPKnownHosts      string
 	S3Enabled           bool
 	S3Region            string
 	S3Endpoint          string
@@ -173,52 +258,97 @@ type config struct {
 
 	ETagEnabled bool
 
-	BaseURL string
+	CoalesceRequests bool
+
+	AllowedProcessingOptions   []string
+	ForbiddenProcessingOptions []string
+	MaxResultWidth             int
+	MaxResultHeight            int
+
+	BaseURL  string
+	BaseURLs map[string]string
+
+	ResultCachePath string
+	SendfileHeader  string
+	SendfilePrefix  string
 
 	Presets presets
 
-	WatermarkData    string
-	WatermarkPath    string
-	WatermarkURL     string
-	WatermarkOpacity float64
+	SourceHosts sourceHosts
+
+	WatermarkData      string
+	WatermarkPath      string
+	WatermarkURL       string
+	WatermarkOpacity   float64
+	WatermarkCacheTTL  int
+	WatermarkCacheSize int
+
+	ObjectDetectionURL        string
+	ObjectDetectionTimeout    int
+	ObjectDetectionConfidence float64
 
 	NewRelicAppName string
 	NewRelicKey     string
 
 	PrometheusBind string
 
+	AdminBind   string
+	AdminSecret string
+
+	LogLevel string
+
+	OTLPEndpoint     string
+	OTLPPushInterval int
+	OTLPServiceName  string
+
 	BugsnagKey     string
 	BugsnagStage   string
 	HoneybadgerKey string
 	HoneybadgerEnv string
+
+	AuditLogPath string
+
+	ErrorWebhookURL      string
+	ErrorWebhookTimeout  int
+	SlowRequestThreshold float64
 }
 
 var conf = config{
-	Bind:                  ":8080",
-	ReadTimeout:           10,
-	WriteTimeout:          10,
-	DownloadTimeout:       5,
-	Concurrency:           runtime.NumCPU() * 2,
-	TTL:                   3600,
-	IgnoreSslVerification: false,
-	MaxSrcResolution:      16800000,
-	MaxGifFrames:          1,
-	AllowInsecure:         false,
-	SignatureSize:         32,
-	Quality:               80,
-	GZipCompression:       5,
-	UserAgent:             fmt.Sprintf("imgproxy/%s", version),
-	ETagEnabled:           false,
-	S3Enabled:             false,
-	WatermarkOpacity:      1,
-	BugsnagStage:          "production",
-	HoneybadgerEnv:        "production",
+	Bind:                      ":8080",
+	ReadTimeout:               10,
+	WriteTimeout:              10,
+	DownloadTimeout:           5,
+	Concurrency:               runtime.NumCPU() * 2,
+	TTL:                       3600,
+	IgnoreSslVerification:     false,
+	MaxSrcResolution:          16800000,
+	MaxGifFrames:              1,
+	AllowInsecure:             false,
+	SignatureSize:             32,
+	Quality:                   80,
+	GZipCompression:           5,
+	UserAgent:                 fmt.Sprintf("imgproxy/%s", version),
+	ETagEnabled:               false,
+	MaxDataURLSize:            256 * 1024,
+	S3Enabled:                 false,
+	WatermarkOpacity:          1,
+	WatermarkCacheTTL:         3600,
+	WatermarkCacheSize:        100,
+	ObjectDetectionTimeout:    5,
+	ObjectDetectionConfidence: 0.5,
+	OTLPPushInterval:          10,
+	OTLPServiceName:           "imgproxy",
+	ErrorWebhookTimeout:       5,
+	LogLevel:                  "info",
+	BugsnagStage:              "production",
+	HoneybadgerEnv:            "production",
 }
 
 func init() {
 	keyPath := flag.String("keypath", "", "path of the file with hex-encoded key")
 	saltPath := flag.String("saltpath", "", "path of the file with hex-encoded salt")
 	presetsPath := flag.String("presets", "", "path of the file with presets")
+	sourceHostsPath := flag.String("sourcehosts", "", "path of the file with source hosts overrides")
 	showVersion := flag.Bool("v", false, "show version")
 	flag.Parse()
 
@@ -234,9 +364,11 @@ func init() {
 	strEnvConfig(&conf.Bind, "IMGPROXY_BIND")
 	intEnvConfig(&conf.ReadTimeout, "IMGPROXY_READ_TIMEOUT")
 	intEnvConfig(&conf.WriteTimeout, "IMGPROXY_WRITE_TIMEOUT")
+	intEnvConfig(&conf.MaxRequestTimeout, "IMGPROXY_MAX_REQUEST_TIMEOUT")
 	intEnvConfig(&conf.DownloadTimeout, "IMGPROXY_DOWNLOAD_TIMEOUT")
 	intEnvConfig(&conf.Concurrency, "IMGPROXY_CONCURRENCY")
 	intEnvConfig(&conf.MaxClients, "IMGPROXY_MAX_CLIENTS")
+	intEnvConfig(&conf.MaxQueue, "IMGPROXY_MAX_QUEUE")
 
 	intEnvConfig(&conf.TTL, "IMGPROXY_TTL")
 
@@ -268,8 +400,23 @@ func init() {
 
 	boolEnvConfig(&conf.IgnoreSslVerification, "IMGPROXY_IGNORE_SSL_VERIFICATION")
 
+	boolEnvConfig(&conf.RejectSourceTypeMismatch, "IMGPROXY_REJECT_SOURCE_TYPE_MISMATCH")
+	boolEnvConfig(&conf.ForbidPolyglots, "IMGPROXY_FORBID_POLYGLOTS")
+
 	strEnvConfig(&conf.LocalFileSystemRoot, "IMGPROXY_LOCAL_FILESYSTEM_ROOT")
 
+	conf.WebDAVServers = make(map[string]string)
+	namedStringsEnvConfig(conf.WebDAVServers, "IMGPROXY_WEBDAV_SERVERS")
+
+	conf.SFTPServers = make(map[string]string)
+	namedStringsEnvConfig(conf.SFTPServers, "IMGPROXY_SFTP_SERVERS")
+	conf.SFTPKeys = make(map[string]string)
+	namedStringsEnvConfig(conf.SFTPKeys, "IMGPROXY_SFTP_KEYS")
+	strEnvConfig(&conf.SFTPKnownHosts, "IMGPROXY_SFTP_KNOWN_HOSTS")
+
+	boolEnvConfig(&conf.AllowDataURLs, "IMGPROXY_ALLOW_DATA_URLS")
+	intEnvConfig(&conf.MaxDataURLSize, "IMGPROXY_MAX_DATA_URL_SIZE")
+
 	boolEnvConfig(&conf.S3Enabled, "IMGPROXY_USE_S3")
 	strEnvConfig(&conf.S3Region, "IMGPROXY_S3_REGION")
 	strEnvConfig(&conf.S3Endpoint, "IMGPROXY_S3_ENDPOINT")
@@ -278,27 +425,66 @@ func init() {
 
 	boolEnvConfig(&conf.ETagEnabled, "IMGPROXY_USE_ETAG")
 
+	boolEnvConfig(&conf.CoalesceRequests, "IMGPROXY_COALESCE_REQUESTS")
+
+	strSliceEnvConfig(&conf.AllowedProcessingOptions, "IMGPROXY_ALLOWED_PROCESSING_OPTIONS")
+	strSliceEnvConfig(&conf.ForbiddenProcessingOptions, "IMGPROXY_FORBIDDEN_PROCESSING_OPTIONS")
+	intEnvConfig(&conf.MaxResultWidth, "IMGPROXY_MAX_RESULT_WIDTH")
+	intEnvConfig(&conf.MaxResultHeight, "IMGPROXY_MAX_RESULT_HEIGHT")
+
+	strEnvConfig(&conf.ResultCachePath, "IMGPROXY_RESULT_CACHE_PATH")
+	strEnvConfig(&conf.SendfileHeader, "IMGPROXY_SENDFILE_HEADER")
+	strEnvConfig(&conf.SendfilePrefix, "IMGPROXY_SENDFILE_PREFIX")
+
 	strEnvConfig(&conf.BaseURL, "IMGPROXY_BASE_URL")
 
+	conf.BaseURLs = make(map[string]string)
+	namedStringsEnvConfig(conf.BaseURLs, "IMGPROXY_BASE_URLS")
+
 	conf.Presets = make(presets)
 	presetEnvConfig(conf.Presets, "IMGPROXY_PRESETS")
 	presetFileConfig(conf.Presets, *presetsPath)
 
+	conf.SourceHosts = make(sourceHosts)
+	sourceHostsEnvConfig(conf.SourceHosts, "IMGPROXY_SOURCE_HOSTS")
+	sourceHostsFileConfig(conf.SourceHosts, *sourceHostsPath)
+
 	strEnvConfig(&conf.WatermarkData, "IMGPROXY_WATERMARK_DATA")
 	strEnvConfig(&conf.WatermarkPath, "IMGPROXY_WATERMARK_PATH")
 	strEnvConfig(&conf.WatermarkURL, "IMGPROXY_WATERMARK_URL")
 	floatEnvConfig(&conf.WatermarkOpacity, "IMGPROXY_WATERMARK_OPACITY")
+	intEnvConfig(&conf.WatermarkCacheTTL, "IMGPROXY_WATERMARK_CACHE_TTL")
+	intEnvConfig(&conf.WatermarkCacheSize, "IMGPROXY_WATERMARK_CACHE_SIZE")
+
+	strEnvConfig(&conf.ObjectDetectionURL, "IMGPROXY_OBJECT_DETECTION_URL")
+	intEnvConfig(&conf.ObjectDetectionTimeout, "IMGPROXY_OBJECT_DETECTION_TIMEOUT")
+	floatEnvConfig(&conf.ObjectDetectionConfidence, "IMGPROXY_OBJECT_DETECTION_CONFIDENCE")
 
 	strEnvConfig(&conf.NewRelicAppName, "IMGPROXY_NEW_RELIC_APP_NAME")
 	strEnvConfig(&conf.NewRelicKey, "IMGPROXY_NEW_RELIC_KEY")
 
 	strEnvConfig(&conf.PrometheusBind, "IMGPROXY_PROMETHEUS_BIND")
 
+	strEnvConfig(&conf.AdminBind, "IMGPROXY_ADMIN_BIND")
+	strEnvConfig(&conf.AdminSecret, "IMGPROXY_ADMIN_SECRET")
+
+	strEnvConfig(&conf.LogLevel, "IMGPROXY_LOG_LEVEL")
+
+	strEnvConfig(&conf.OTLPEndpoint, "IMGPROXY_OTLP_ENDPOINT")
+	intEnvConfig(&conf.OTLPPushInterval, "IMGPROXY_OTLP_PUSH_INTERVAL")
+	strEnvConfig(&conf.OTLPServiceName, "IMGPROXY_OTLP_SERVICE_NAME")
+
 	strEnvConfig(&conf.BugsnagKey, "IMGPROXY_BUGSNAG_KEY")
 	strEnvConfig(&conf.BugsnagStage, "IMGPROXY_BUGSNAG_STAGE")
 	strEnvConfig(&conf.HoneybadgerKey, "IMGPROXY_HONEYBADGER_KEY")
 	strEnvConfig(&conf.HoneybadgerEnv, "IMGPROXY_HONEYBADGER_ENV")
 
+	strEnvConfig(&conf.AuditLogPath, "IMGPROXY_AUDIT_LOG_PATH")
+
+	strEnvConfig(&conf.ErrorWebhookURL, "IMGPROXY_ERROR_WEBHOOK_URL")
+	intEnvConfig(&conf.ErrorWebhookTimeout, "IMGPROXY_ERROR_WEBHOOK_TIMEOUT")
+	floatEnvConfig(&conf.SlowRequestThreshold, "IMGPROXY_SLOW_REQUEST_THRESHOLD")
+
 	if len(conf.Keys) != len(conf.Salts) {
 		log.Fatalf("Number of keys and number of salts should be equal. Keys: %d, salts: %d", len(conf.Keys), len(conf.Salts))
 	}
@@ -327,6 +513,12 @@ func init() {
 		log.Fatalf("Write timeout should be greater than 0, now - %d\n", conf.WriteTimeout)
 	}
 
+	if conf.MaxRequestTimeout <= 0 {
+		conf.MaxRequestTimeout = conf.WriteTimeout
+	} else if conf.MaxRequestTimeout < conf.WriteTimeout {
+		log.Fatalf("Max request timeout should be greater than or equal to write timeout, now - %d\n", conf.MaxRequestTimeout)
+	}
+
 	if conf.DownloadTimeout <= 0 {
 		log.Fatalf("Download timeout should be greater than 0, now - %d\n", conf.DownloadTimeout)
 	}
@@ -339,6 +531,10 @@ func init() {
 		conf.MaxClients = conf.Concurrency * 10
 	}
 
+	if conf.MaxQueue < 0 {
+		log.Fatalf("Max queue should be greater than or equal to 0, now - %d\n", conf.MaxQueue)
+	}
+
 	if conf.TTL <= 0 {
 		log.Fatalf("TTL should be greater than 0, now - %d\n", conf.TTL)
 	}
@@ -369,6 +565,17 @@ func init() {
 		log.Fatalf("GZip compression can't be greater than 9, now - %d\n", conf.GZipCompression)
 	}
 
+	processingOptionsNamesConfig(conf.AllowedProcessingOptions, "IMGPROXY_ALLOWED_PROCESSING_OPTIONS")
+	processingOptionsNamesConfig(conf.ForbiddenProcessingOptions, "IMGPROXY_FORBIDDEN_PROCESSING_OPTIONS")
+
+	if conf.MaxResultWidth < 0 {
+		log.Fatalf("Max result width should be greater than or equal to 0, now - %d\n", conf.MaxResultWidth)
+	}
+
+	if conf.MaxResultHeight < 0 {
+		log.Fatalf("Max result height should be greater than or equal to 0, now - %d\n", conf.MaxResultHeight)
+	}
+
 	if conf.IgnoreSslVerification {
 		warning("Ignoring SSL verification is very unsafe")
 	}
@@ -387,6 +594,62 @@ func init() {
 		}
 	}
 
+	if len(conf.SendfileHeader) > 0 {
+		conf.SendfileHeader = http.CanonicalHeaderKey(conf.SendfileHeader)
+
+		if conf.SendfileHeader != "X-Accel-Redirect" && conf.SendfileHeader != "X-Sendfile" {
+			log.Fatalf("Sendfile header should be X-Accel-Redirect or X-Sendfile, now - %s\n", conf.SendfileHeader)
+		}
+
+		if len(conf.ResultCachePath) == 0 {
+			log.Fatalln("Sendfile header can't be used without result cache")
+		}
+
+		if len(conf.SendfilePrefix) == 0 {
+			if conf.SendfileHeader == "X-Accel-Redirect" {
+				log.Fatalln("Sendfile prefix should be set to use X-Accel-Redirect")
+			}
+
+			prefix, err := filepath.Abs(conf.ResultCachePath)
+			if err != nil {
+				log.Fatalf("Can't resolve result cache path: %s", err)
+			}
+
+			conf.SendfilePrefix = prefix
+		}
+	}
+
+	for name, server := range conf.WebDAVServers {
+		if u, err := url.Parse(server); err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			log.Fatalf("Invalid WebDAV server URL: %s\n", name)
+		}
+	}
+
+	for name, server := range conf.SFTPServers {
+		u, err := url.Parse(server)
+		if err != nil || u.Scheme != "sftp" || len(u.Host) == 0 || u.User == nil {
+			log.Fatalf("Invalid SFTP server URL: %s\n", name)
+		}
+
+		if _, ok := u.User.Password(); !ok && len(conf.SFTPKeys[name]) == 0 {
+			log.Fatalf("SFTP server %s has neither password nor key\n", name)
+		}
+	}
+
+	for name := range conf.SFTPKeys {
+		if _, ok := conf.SFTPServers[name]; !ok {
+			log.Fatalf("SFTP key is defined for unknown server: %s\n", name)
+		}
+	}
+
+	if len(conf.SFTPServers) > 0 && len(conf.SFTPKnownHosts) == 0 {
+		log.Fatalln("SFTP known hosts file should be specified to verify SFTP servers")
+	}
+
+	if conf.MaxDataURLSize <= 0 {
+		log.Fatalf("Max data URL size should be greater than 0, now - %d\n", conf.MaxDataURLSize)
+	}
+
 	if err := checkPresets(conf.Presets); err != nil {
 		log.Fatalln(err)
 	}
@@ -397,13 +660,72 @@ func init() {
 		log.Fatalln("Watermark opacity should be less than or equal to 1")
 	}
 
+	if conf.WatermarkCacheTTL < 0 {
+		log.Fatalf("Watermark cache TTL should be greater than or equal to 0, now - %d\n", conf.WatermarkCacheTTL)
+	}
+
+	if conf.WatermarkCacheSize <= 0 {
+		log.Fatalf("Watermark cache size should be greater than 0, now - %d\n", conf.WatermarkCacheSize)
+	}
+
+	if conf.ObjectDetectionTimeout <= 0 {
+		log.Fatalf("Object detection timeout should be greater than 0, now - %d\n", conf.ObjectDetectionTimeout)
+	}
+
+	if conf.ObjectDetectionConfidence < 0 || conf.ObjectDetectionConfidence > 1 {
+		log.Fatalf("Object detection confidence should be within 0 and 1, now - %f\n", conf.ObjectDetectionConfidence)
+	}
+
 	if len(conf.PrometheusBind) > 0 && conf.PrometheusBind == conf.Bind {
 		log.Fatalln("Can't use the same binding for the main server and Prometheus")
 	}
 
+	if len(conf.AdminBind) > 0 {
+		if conf.AdminBind == conf.Bind || conf.AdminBind == conf.PrometheusBind {
+			log.Fatalln("Can't use the same binding for the admin server and the main or Prometheus server")
+		}
+
+		if len(conf.AdminSecret) == 0 {
+			log.Fatalln("Admin secret should be set to use the admin server")
+		}
+	}
+
+	if err := setLogLevel(conf.LogLevel); err != nil {
+		log.Fatalln(err)
+	}
+
+	if len(conf.OTLPEndpoint) > 0 {
+		if _, err := url.ParseRequestURI(conf.OTLPEndpoint); err != nil {
+			log.Fatalf("Invalid OTLP endpoint: %s\n", conf.OTLPEndpoint)
+		}
+	}
+
+	if len(conf.ErrorWebhookURL) > 0 {
+		if _, err := url.ParseRequestURI(conf.ErrorWebhookURL); err != nil {
+			log.Fatalf("Invalid error webhook URL: %s\n", conf.ErrorWebhookURL)
+		}
+	}
+
+	if conf.ErrorWebhookTimeout <= 0 {
+		log.Fatalf("Error webhook timeout should be greater than 0, now - %d\n", conf.ErrorWebhookTimeout)
+	}
+
+	if conf.SlowRequestThreshold < 0 {
+		log.Fatalf("Slow request threshold should be greater than or equal to 0, now - %f\n", conf.SlowRequestThreshold)
+	}
+
+	if conf.OTLPPushInterval <= 0 {
+		log.Fatalf("OTLP push interval should be greater than 0, now - %d\n", conf.OTLPPushInterval)
+	}
+
 	initDownloading()
 	initNewrelic()
 	initPrometheus()
+	initOTLP()
 	initErrorsReporting()
+	initErrorWebhook()
+	initAuditLog()
+	initObjectDetection()
+	initResultCache()
 	initVips()
 }
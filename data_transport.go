@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// The maximum length of the data URL part that is kept in logs: the scheme and the media type
+const dataURLLogHeadLen = 64
+
+var (
+	errDataURLTooBig = errors.New("Data URL is too big")
+
+	plainDataURLMarkers = []string{"/plain/data:", "/plain/data%3A", "/plain/data%3a"}
+
+	// Base64-encoded "data:". The last character of the encoded "data:" depends on
+	// the next byte as well, so it's not included
+	base64DataURLMarker = "ZGF0YT"
+)
+
+// dataTransport implements RoundTripper for the 'data' protocol.
+// It doesn't fetch anything and just responds with the data contained in the URL
+type dataTransport struct{}
+
+func newDataTransport() http.RoundTripper {
+	return dataTransport{}
+}
+
+func decodeDataURL(str string) ([]byte, string, error) {
+	parts := strings.SplitN(strings.TrimPrefix(str, "data:"), ",", 2)
+	if len(parts) != 2 {
+		return nil, "", errors.New("Invalid data URL")
+	}
+
+	mediaType, encoded := parts[0], parts[1]
+
+	var (
+		data []byte
+		err  error
+	)
+
+	if strings.HasSuffix(mediaType, ";base64") {
+		mediaType = strings.TrimSuffix(mediaType, ";base64")
+		encoded = strings.TrimRight(encoded, "=")
+
+		// Check the size before decoding to not allocate memory for huge data
+		if base64.RawStdEncoding.DecodedLen(len(encoded)) > conf.MaxDataURLSize {
+			return nil, "", errDataURLTooBig
+		}
+
+		if data, err = base64.RawStdEncoding.DecodeString(encoded); err != nil {
+			if data, err = base64.RawURLEncoding.DecodeString(encoded); err != nil {
+				return nil, "", fmt.Errorf("Invalid data URL encoding: %s", err)
+			}
+		}
+	} else {
+		var unescaped string
+
+		if unescaped, err = url.PathUnescape(encoded); err != nil {
+			return nil, "", fmt.Errorf("Invalid data URL encoding: %s", err)
+		}
+
+		data = []byte(unescaped)
+	}
+
+	if len(data) > conf.MaxDataURLSize {
+		return nil, "", errDataURLTooBig
+	}
+
+	// Media type can contain parameters, we need only the type itself
+	mediaType = strings.SplitN(mediaType, ";", 2)[0]
+
+	return data, mediaType, nil
+}
+
+func (t dataTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	str := req.URL.Opaque
+
+	// Data can contain "?"
+	if len(req.URL.RawQuery) > 0 || req.URL.ForceQuery {
+		str = str + "?" + req.URL.RawQuery
+	}
+
+	data, mediaType, err := decodeDataURL(str)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make(http.Header)
+
+	if len(mediaType) > 0 {
+		header.Set("Content-Type", mediaType)
+	}
+
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    200,
+		Proto:         "HTTP/1.0",
+		ProtoMajor:    1,
+		ProtoMinor:    0,
+		Header:        header,
+		ContentLength: int64(len(data)),
+		Body:          ioutil.NopCloser(bytes.NewReader(data)),
+		Close:         true,
+		Request:       req,
+	}, nil
+}
+
+// redactDataURL replaces the data URL payload with its size, so data URLs don't flood
+// logs and webhooks. Media type is kept since it's useful for debugging
+func redactDataURL(str string) string {
+	if !strings.HasPrefix(str, "data:") {
+		return str
+	}
+
+	head := len("data:")
+	if i := strings.IndexByte(str, ','); i >= 0 && i < dataURLLogHeadLen {
+		head = i + 1
+	}
+
+	return redactTail(str, head)
+}
+
+// redactRequestURI replaces data URLs payloads in the request URI with their sizes.
+// Source URL can be plain or base64-encoded, watermark URL is always base64-encoded
+func redactRequestURI(uri string) string {
+	var tail string
+
+	// Plain source URL is the last part of the path, so we redact everything after the marker
+	for _, m := range plainDataURLMarkers {
+		if i := strings.Index(uri, m); i >= 0 {
+			i += len("/plain/")
+
+			if strings.HasPrefix(uri[i:], "data:") {
+				tail = redactDataURL(uri[i:])
+			} else {
+				tail = redactTail(uri[i:], len(m)-len("/plain/"))
+			}
+
+			uri = uri[:i]
+			break
+		}
+	}
+
+	for start := 0; ; {
+		i := strings.Index(uri[start:], base64DataURLMarker)
+		if i < 0 {
+			break
+		}
+
+		i += start
+		start = i + len(base64DataURLMarker)
+
+		if i == 0 || (uri[i-1] != '/' && uri[i-1] != ':') {
+			continue
+		}
+
+		// Encoded source URL can be split with slashes and is the last part of the path,
+		// while watermark URL is an option argument and ends with the option
+		end := len(uri)
+		if uri[i-1] == ':' {
+			if j := strings.IndexByte(uri[i:], '/'); j >= 0 {
+				end = i + j
+			}
+		}
+
+		redacted := uri[:i] + redactTail(uri[i:end], len(base64DataURLMarker))
+		uri, start = redacted+uri[end:], len(redacted)
+	}
+
+	return uri + tail
+}
+
+// redactProcessingOptions returns the copy of the processing options
+// with the watermark data URL payload redacted
+func redactProcessingOptions(po *processingOptions) *processingOptions {
+	if po == nil || !strings.HasPrefix(po.Watermark.URL, "data:") {
+		return po
+	}
+
+	rpo := *po
+	rpo.Watermark.URL = redactDataURL(po.Watermark.URL)
+
+	return &rpo
+}
+
+func redactTail(str string, head int) string {
+	return fmt.Sprintf("%s…(%d bytes)", str[:head], len(str)-head)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type DataTransportTestSuite struct{ MainTestSuite }
+
+func (s *DataTransportTestSuite) TestDecodeBase64() {
+	data, mediaType, err := decodeDataURL("data:image/png;base64,dGVzdA==")
+
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), []byte("test"), data)
+	assert.Equal(s.T(), "image/png", mediaType)
+}
+
+func (s *DataTransportTestSuite) TestDecodeBase64Unpadded() {
+	data, _, err := decodeDataURL("data:image/png;base64,dGVzdA")
+
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), []byte("test"), data)
+}
+
+func (s *DataTransportTestSuite) TestDecodePercentEncoded() {
+	data, mediaType, err := decodeDataURL("data:image/svg+xml;charset=utf-8,%3Csvg%3E%3C%2Fsvg%3E")
+
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), []byte("<svg></svg>"), data)
+	assert.Equal(s.T(), "image/svg+xml", mediaType)
+}
+
+func (s *DataTransportTestSuite) TestDecodeInvalid() {
+	_, _, err := decodeDataURL("data:image/png;base64")
+	assert.Error(s.T(), err)
+
+	_, _, err = decodeDataURL("data:image/png;base64,!!!")
+	assert.Error(s.T(), err)
+}
+
+func (s *DataTransportTestSuite) TestDecodeTooBig() {
+	conf.MaxDataURLSize = 3
+
+	_, _, err := decodeDataURL("data:image/png;base64,dGVzdA==")
+	assert.Equal(s.T(), errDataURLTooBig, err)
+
+	_, _, err = decodeDataURL("data:image/png,test")
+	assert.Equal(s.T(), errDataURLTooBig, err)
+}
+
+func (s *DataTransportTestSuite) TestRoundTrip() {
+	transport := &http.Transport{}
+	transport.RegisterProtocol("data", newDataTransport())
+
+	client := &http.Client{Transport: transport}
+
+	res, err := client.Get("data:image/png;base64,dGVzdA==")
+	require.Nil(s.T(), err)
+	defer res.Body.Close()
+
+	body, _ := ioutil.ReadAll(res.Body)
+
+	assert.Equal(s.T(), 200, res.StatusCode)
+	assert.Equal(s.T(), "image/png", res.Header.Get("Content-Type"))
+	assert.Equal(s.T(), []byte("test"), body)
+}
+
+func (s *DataTransportTestSuite) TestRedactDataURL() {
+	assert.Equal(s.T(), "data:image/png;base64,…(8 bytes)", redactDataURL("data:image/png;base64,dGVzdA=="))
+	assert.Equal(s.T(), "data:…(8 bytes)", redactDataURL("data:dGVzdA=="))
+	assert.Equal(s.T(), "http://images.dev/lorem/ipsum.jpg", redactDataURL("http://images.dev/lorem/ipsum.jpg"))
+}
+
+func (s *DataTransportTestSuite) TestRedactRequestURIPlain() {
+	assert.Equal(
+		s.T(),
+		"/unsafe/w:100/plain/data:image/png;base64,…(8 bytes)",
+		redactRequestURI("/unsafe/w:100/plain/data:image/png;base64,dGVzdA=="),
+	)
+}
+
+func (s *DataTransportTestSuite) TestRedactRequestURIBase64() {
+	source := base64.RawURLEncoding.EncodeToString([]byte("data:image/png;base64,dGVzdA=="))
+	wm := base64.RawURLEncoding.EncodeToString([]byte("data:image/png;base64,d2F0ZXJtYXJr"))
+
+	assert.Equal(
+		s.T(),
+		// Slash and extension of the source URL are redacted too
+		fmt.Sprintf("/unsafe/wmu:ZGF0YT…(%d bytes)/w:100/ZGF0YT…(%d bytes)", len(wm)-6, len(source)-1),
+		redactRequestURI("/unsafe/wmu:"+wm+"/w:100/"+source[:20]+"/"+source[20:]+".png"),
+	)
+}
+
+func (s *DataTransportTestSuite) TestRedactRequestURIPlainEscaped() {
+	assert.Equal(
+		s.T(),
+		"/unsafe/w:100/plain/data%3A…(25 bytes)",
+		redactRequestURI("/unsafe/w:100/plain/data%3Aimage/png;base64,dGVzdA=="),
+	)
+}
+
+func (s *DataTransportTestSuite) TestRedactRequestURINoDataURL() {
+	uri := "/unsafe/w:100/plain/http://images.dev/lorem/ipsum.jpg"
+	assert.Equal(s.T(), uri, redactRequestURI(uri))
+
+	uri = "/unsafe/w:100/" + base64.RawURLEncoding.EncodeToString([]byte("http://images.dev/lorem/ipsum.jpg"))
+	assert.Equal(s.T(), uri, redactRequestURI(uri))
+}
+
+func (s *DataTransportTestSuite) TestRedactProcessingOptions() {
+	po := &processingOptions{Width: 100}
+	po.Watermark.URL = "data:image/png;base64,dGVzdA=="
+
+	rpo := redactProcessingOptions(po)
+
+	assert.Equal(s.T(), 100, rpo.Width)
+	assert.Equal(s.T(), "data:image/png;base64,…(8 bytes)", rpo.Watermark.URL)
+	assert.Equal(s.T(), "data:image/png;base64,dGVzdA==", po.Watermark.URL)
+}
+
+func TestDataTransport(t *testing.T) {
+	suite.Run(t, new(DataTransportTestSuite))
+}
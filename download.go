@@ -9,6 +9,7 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
@@ -51,6 +52,18 @@ func initDownloading() {
 		transport.RegisterProtocol("local", http.NewFileTransport(http.Dir(conf.LocalFileSystemRoot)))
 	}
 
+	if len(conf.WebDAVServers) > 0 {
+		transport.RegisterProtocol("webdav", newWebDAVTransport(transport))
+	}
+
+	if len(conf.SFTPServers) > 0 {
+		transport.RegisterProtocol("sftp", newSFTPTransport())
+	}
+
+	if conf.AllowDataURLs {
+		transport.RegisterProtocol("data", newDataTransport())
+	}
+
 	if conf.S3Enabled {
 		transport.RegisterProtocol("s3", newS3Transport())
 	}
@@ -65,19 +78,22 @@ func initDownloading() {
 	}
 }
 
-func checkDimensions(width, height int) error {
-	if conf.MaxSrcDimension > 0 && (width > conf.MaxSrcDimension || height > conf.MaxSrcDimension) {
+func checkDimensions(width, height int, hc *sourceHostConfig) error {
+	if hc.MaxSrcDimension > 0 && (width > hc.MaxSrcDimension || height > hc.MaxSrcDimension) {
 		return errSourceDimensionsTooBig
 	}
 
-	if width*height > conf.MaxSrcResolution {
+	if width*height > hc.MaxSrcResolution {
 		return errSourceResolutionTooBig
 	}
 
 	return nil
 }
 
-func checkTypeAndDimensions(r io.Reader) (imageType, error) {
+// checkTypeAndDimensions detects the image type by its content: image.DecodeConfig
+// chooses the decoder by the magic number, and then we load the image with the libvips
+// loader of the detected type, so the Content-Type header and the extension don't matter
+func checkTypeAndDimensions(r io.Reader, hc *sourceHostConfig) (imageType, error) {
 	imgconf, imgtypeStr, err := image.DecodeConfig(r)
 	if err != nil {
 		return imageTypeUnknown, errSourceImageTypeNotSupported
@@ -88,35 +104,53 @@ func checkTypeAndDimensions(r io.Reader) (imageType, error) {
 		return imageTypeUnknown, errSourceImageTypeNotSupported
 	}
 
-	if err = checkDimensions(imgconf.Width, imgconf.Height); err != nil {
+	if err = checkDimensions(imgconf.Width, imgconf.Height, hc); err != nil {
 		return imageTypeUnknown, err
 	}
 
 	return imgtype, nil
 }
 
-func readAndCheckImage(ctx context.Context, res *http.Response) (context.Context, context.CancelFunc, error) {
+func readAndCheckImage(ctx context.Context, res *http.Response, hc *sourceHostConfig) (context.Context, context.CancelFunc, error) {
 	buf := downloadBufPool.Get().(*bytes.Buffer)
 	cancel := func() {
 		buf.Reset()
 		downloadBufPool.Put(buf)
 	}
 
-	imgtype, err := checkTypeAndDimensions(io.TeeReader(res.Body, buf))
+	imgtype, err := checkTypeAndDimensions(io.TeeReader(res.Body, buf), hc)
 	if err != nil {
 		return ctx, cancel, err
 	}
 
+	if conf.RejectSourceTypeMismatch {
+		if err = checkSourceTypeMismatch(res, imgtype); err != nil {
+			return ctx, cancel, err
+		}
+	}
+
 	if _, err = buf.ReadFrom(res.Body); err != nil {
 		return ctx, cancel, newError(404, err.Error(), msgSourceImageIsUnreachable)
 	}
 
+	if conf.ForbidPolyglots {
+		if err = checkPolyglot(buf.Bytes()); err != nil {
+			return ctx, cancel, err
+		}
+	}
+
 	ctx = context.WithValue(ctx, imageTypeCtxKey, imgtype)
 	ctx = context.WithValue(ctx, imageDataCtxKey, buf)
 
 	return ctx, cancel, nil
 }
 
+// downloadErrorMessage returns the error message with the data URL payload redacted,
+// since download errors contain the requested URL
+func downloadErrorMessage(err error, url string) string {
+	return strings.Replace(err.Error(), url, redactDataURL(url), -1)
+}
+
 func downloadImage(ctx context.Context) (context.Context, context.CancelFunc, error) {
 	url := getImageURL(ctx)
 
@@ -129,16 +163,26 @@ func downloadImage(ctx context.Context) (context.Context, context.CancelFunc, er
 		defer startPrometheusDuration(prometheusDownloadDuration)()
 	}
 
+	if otlpEnabled {
+		defer startOTLPDuration(ctx, otlpDownloadDuration)()
+	}
+
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		return ctx, func() {}, newError(404, err.Error(), msgSourceImageIsUnreachable)
+		return ctx, func() {}, newError(404, downloadErrorMessage(err, url), msgSourceImageIsUnreachable)
 	}
 
 	req.Header.Set("User-Agent", conf.UserAgent)
 
+	hc := sourceHostConfigFor(url)
+
+	for name, value := range hc.Headers {
+		req.Header.Set(name, value)
+	}
+
 	res, err := downloadClient.Do(req)
 	if err != nil {
-		return ctx, func() {}, newError(404, err.Error(), msgSourceImageIsUnreachable)
+		return ctx, func() {}, newError(404, downloadErrorMessage(err, url), msgSourceImageIsUnreachable)
 	}
 	defer res.Body.Close()
 
@@ -148,7 +192,7 @@ func downloadImage(ctx context.Context) (context.Context, context.CancelFunc, er
 		return ctx, func() {}, newError(404, msg, msgSourceImageIsUnreachable)
 	}
 
-	return readAndCheckImage(ctx, res)
+	return readAndCheckImage(ctx, res, hc)
 }
 
 func getImageType(ctx context.Context) imageType {
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const (
+	errorWebhookEventError       = "error"
+	errorWebhookEventSlowRequest = "slow_request"
+
+	errorWebhookQueueSize = 100
+)
+
+var (
+	errorWebhookEnabled = false
+
+	errorWebhookClient *http.Client
+	errorWebhookQueue  chan *errorWebhookEvent
+
+	requestIDCtxKey = ctxKey("requestID")
+)
+
+type errorWebhookEvent struct {
+	Event     string             `json:"event"`
+	RequestID string             `json:"request_id"`
+	Time      string             `json:"time"`
+	Status    int                `json:"status,omitempty"`
+	Message   string             `json:"message,omitempty"`
+	Source    string             `json:"source,omitempty"`
+	Options   *processingOptions `json:"options,omitempty"`
+	Duration  float64            `json:"duration"`
+}
+
+func initErrorWebhook() {
+	if len(conf.ErrorWebhookURL) == 0 {
+		return
+	}
+
+	errorWebhookClient = &http.Client{
+		Timeout: time.Duration(conf.ErrorWebhookTimeout) * time.Second,
+	}
+
+	errorWebhookQueue = make(chan *errorWebhookEvent, errorWebhookQueueSize)
+
+	go func() {
+		for e := range errorWebhookQueue {
+			if err := sendErrorWebhookEvent(e); err != nil {
+				warning("Can't send event to error webhook: %s", err)
+			}
+		}
+	}()
+
+	errorWebhookEnabled = true
+}
+
+// newErrorWebhookEvent fills the event with request data. The request can fail before
+// the image URL and processing options are parsed, so we can't rely on them being in the context
+func newErrorWebhookEvent(ctx context.Context, event string) *errorWebhookEvent {
+	e := errorWebhookEvent{
+		Event: event,
+		Time:  time.Now().Format(time.RFC3339),
+	}
+
+	e.RequestID, _ = ctx.Value(requestIDCtxKey).(string)
+	if imageURL, ok := ctx.Value(imageURLCtxKey).(string); ok {
+		e.Source = redactDataURL(imageURL)
+	}
+
+	if po, ok := ctx.Value(processingOptionsCtxKey).(*processingOptions); ok {
+		e.Options = redactProcessingOptions(po)
+	}
+
+	if t, ok := ctx.Value(timerSinceCtxKey).(time.Time); ok {
+		e.Duration = time.Since(t).Seconds()
+	}
+
+	return &e
+}
+
+func enqueueErrorWebhookEvent(e *errorWebhookEvent) {
+	select {
+	case errorWebhookQueue <- e:
+	default:
+		warning("Error webhook queue is full, event dropped: [%s] %s", e.RequestID, e.Event)
+	}
+}
+
+func sendErrorToWebhook(ctx context.Context, err error) {
+	e := newErrorWebhookEvent(ctx, errorWebhookEventError)
+
+	if ierr, ok := err.(*imgproxyError); ok {
+		e.Status = ierr.StatusCode
+		e.Message = ierr.Message
+	} else {
+		e.Status = 500
+		e.Message = err.Error()
+	}
+
+	enqueueErrorWebhookEvent(e)
+}
+
+func checkSlowRequest(ctx context.Context) {
+	if conf.SlowRequestThreshold <= 0 {
+		return
+	}
+
+	t, ok := ctx.Value(timerSinceCtxKey).(time.Time)
+	if !ok || time.Since(t).Seconds() < conf.SlowRequestThreshold {
+		return
+	}
+
+	enqueueErrorWebhookEvent(newErrorWebhookEvent(ctx, errorWebhookEventSlowRequest))
+}
+
+func sendErrorWebhookEvent(e *errorWebhookEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", conf.ErrorWebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", conf.UserAgent)
+
+	res, err := errorWebhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("Status: %d; %s", res.StatusCode, string(msg))
+	}
+
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type ErrorWebhookTestSuite struct{ MainTestSuite }
+
+func (s *ErrorWebhookTestSuite) SetupTest() {
+	s.MainTestSuite.SetupTest()
+
+	errorWebhookClient = &http.Client{Timeout: time.Second}
+	errorWebhookQueue = make(chan *errorWebhookEvent, 1)
+}
+
+func (s *ErrorWebhookTestSuite) TestErrorEvent() {
+	po := &processingOptions{Width: 100}
+
+	ctx := context.WithValue(context.Background(), requestIDCtxKey, "test-id")
+	ctx = context.WithValue(ctx, imageURLCtxKey, "http://images.dev/lorem/ipsum.jpg")
+	ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+	sendErrorToWebhook(ctx, newError(404, "Not found", "Not found"))
+
+	e := <-errorWebhookQueue
+
+	assert.Equal(s.T(), errorWebhookEventError, e.Event)
+	assert.Equal(s.T(), "test-id", e.RequestID)
+	assert.Equal(s.T(), 404, e.Status)
+	assert.Equal(s.T(), "Not found", e.Message)
+	assert.Equal(s.T(), "http://images.dev/lorem/ipsum.jpg", e.Source)
+	assert.Equal(s.T(), po, e.Options)
+}
+
+func (s *ErrorWebhookTestSuite) TestErrorEventDataURL() {
+	po := &processingOptions{Width: 100}
+	po.Watermark.URL = "data:image/png;base64,dGVzdA=="
+
+	ctx := context.WithValue(context.Background(), imageURLCtxKey, "data:image/png;base64,dGVzdA==")
+	ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
+
+	sendErrorToWebhook(ctx, newError(404, "Not found", "Not found"))
+
+	e := <-errorWebhookQueue
+
+	assert.Equal(s.T(), "data:image/png;base64,…(8 bytes)", e.Source)
+	assert.Equal(s.T(), "data:image/png;base64,…(8 bytes)", e.Options.Watermark.URL)
+}
+
+func (s *ErrorWebhookTestSuite) TestErrorEventBeforeParsing() {
+	ctx := context.WithValue(context.Background(), requestIDCtxKey, "test-id")
+
+	sendErrorToWebhook(ctx, errors.New("Unexpected"))
+
+	e := <-errorWebhookQueue
+
+	assert.Equal(s.T(), 500, e.Status)
+	assert.Empty(s.T(), e.Source)
+	assert.Nil(s.T(), e.Options)
+}
+
+func (s *ErrorWebhookTestSuite) TestSlowRequest() {
+	conf.SlowRequestThreshold = 1
+
+	ctx := context.WithValue(context.Background(), timerSinceCtxKey, time.Now())
+	checkSlowRequest(ctx)
+
+	assert.Len(s.T(), errorWebhookQueue, 0)
+
+	ctx = context.WithValue(context.Background(), timerSinceCtxKey, time.Now().Add(-2*time.Second))
+	checkSlowRequest(ctx)
+
+	require.Len(s.T(), errorWebhookQueue, 1)
+
+	e := <-errorWebhookQueue
+
+	assert.Equal(s.T(), errorWebhookEventSlowRequest, e.Event)
+	assert.True(s.T(), e.Duration >= 2)
+}
+
+func (s *ErrorWebhookTestSuite) TestQueueFull() {
+	ctx := context.WithValue(context.Background(), requestIDCtxKey, "test-id")
+
+	sendErrorToWebhook(ctx, errors.New("First"))
+	sendErrorToWebhook(ctx, errors.New("Second"))
+
+	e := <-errorWebhookQueue
+
+	assert.Equal(s.T(), "First", e.Message)
+	assert.Len(s.T(), errorWebhookQueue, 0)
+}
+
+func (s *ErrorWebhookTestSuite) TestSendEvent() {
+	var payload map[string]interface{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		assert.Equal(s.T(), "application/json", r.Header.Get("Content-Type"))
+
+		json.NewDecoder(r.Body).Decode(&payload)
+		rw.WriteHeader(200)
+	}))
+	defer server.Close()
+
+	conf.ErrorWebhookURL = server.URL
+
+	err := sendErrorWebhookEvent(&errorWebhookEvent{Event: errorWebhookEventError, RequestID: "test-id", Status: 404})
+
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), "error", payload["event"])
+	assert.Equal(s.T(), "test-id", payload["request_id"])
+	assert.Equal(s.T(), 404.0, payload["status"])
+}
+
+func TestErrorWebhook(t *testing.T) {
+	suite.Run(t, new(ErrorWebhookTestSuite))
+}
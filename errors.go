@@ -41,5 +41,9 @@ func stacktrace(skip int) string {
 }
 
 func warning(f string, args ...interface{}) {
+	if !logLevelEnabled(logLevelWarning) {
+		return
+	}
+
 	log.Printf("\033[1;33m[WARNING]\033[0m %s", fmt.Sprintf(f, args...))
 }
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+const (
+	logLevelInfo int32 = iota
+	logLevelWarning
+	logLevelError
+)
+
+var (
+	logLevelNames = map[string]int32{
+		"info":    logLevelInfo,
+		"warning": logLevelWarning,
+		"error":   logLevelError,
+	}
+
+	// Log level can be changed at runtime via admin endpoint, so it's accessed atomically
+	currentLogLevel = logLevelInfo
+)
+
+func setLogLevel(name string) error {
+	level, ok := logLevelNames[name]
+	if !ok {
+		return fmt.Errorf("Invalid log level: %s", name)
+	}
+
+	atomic.StoreInt32(&currentLogLevel, level)
+
+	return nil
+}
+
+func getLogLevel() string {
+	level := atomic.LoadInt32(&currentLogLevel)
+
+	for name, l := range logLevelNames {
+		if l == level {
+			return name
+		}
+	}
+
+	return ""
+}
+
+func logLevelEnabled(level int32) bool {
+	return level >= atomic.LoadInt32(&currentLogLevel)
+}
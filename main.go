@@ -27,5 +27,6 @@ func main() {
 	<-stop
 
 	shutdownServer(s)
+	shutdownOTLP()
 	shutdownVips()
 }
@@ -45,19 +45,30 @@ func startNewRelicTransaction(ctx context.Context, rw http.ResponseWriter, r *ht
 	return context.WithValue(ctx, newRelicTransactionCtxKey, txn), cancel
 }
 
+// Downloads shared between requests are not bound to any request transaction,
+// so New Relic helpers do nothing when there is no transaction in the context
 func startNewRelicSegment(ctx context.Context, name string) context.CancelFunc {
-	txn := ctx.Value(newRelicTransactionCtxKey).(newrelic.Transaction)
+	txn, ok := ctx.Value(newRelicTransactionCtxKey).(newrelic.Transaction)
+	if !ok {
+		return func() {}
+	}
+
 	segment := newrelic.StartSegment(txn, name)
 	return func() { segment.End() }
 }
 
 func sendErrorToNewRelic(ctx context.Context, err error) {
-	txn := ctx.Value(newRelicTransactionCtxKey).(newrelic.Transaction)
-	txn.NoticeError(err)
+	if txn, ok := ctx.Value(newRelicTransactionCtxKey).(newrelic.Transaction); ok {
+		txn.NoticeError(err)
+	}
 }
 
 func sendTimeoutToNewRelic(ctx context.Context, d time.Duration) {
-	txn := ctx.Value(newRelicTransactionCtxKey).(newrelic.Transaction)
+	txn, ok := ctx.Value(newRelicTransactionCtxKey).(newrelic.Transaction)
+	if !ok {
+		return
+	}
+
 	txn.NoticeError(newrelic.Error{
 		Message: "Timeout",
 		Class:   "Timeout",
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"time"
+)
+
+type detectedObject struct {
+	Class      string  `json:"class"`
+	Confidence float64 `json:"confidence"`
+	X          float64 `json:"x"`
+	Y          float64 `json:"y"`
+	Width      float64 `json:"width"`
+	Height     float64 `json:"height"`
+}
+
+// detectedObjects contains objects detected on the image of the specified size
+type detectedObjects struct {
+	width   int
+	height  int
+	objects []detectedObject
+}
+
+// objectDetector detects objects on the encoded image. Coordinates of the detected
+// objects are expected to be in pixels of the provided image.
+type objectDetector interface {
+	detect(data []byte, imgtype imageType) ([]detectedObject, error)
+}
+
+var (
+	objectDetectionEnabled = false
+
+	objectDetectionBackend objectDetector
+
+	errObjectDetectionNotConfigured = errors.New("Object detection is not configured")
+
+	detectedObjectsCtxKey = ctxKey("detectedObjects")
+)
+
+// httpObjectDetector sends images to the external detection service (darknet, ONNX runtime
+// or any other model server) and reads detected objects as JSON.
+type httpObjectDetector struct {
+	url    string
+	client *http.Client
+}
+
+func initObjectDetection() {
+	if len(conf.ObjectDetectionURL) == 0 {
+		return
+	}
+
+	objectDetectionBackend = &httpObjectDetector{
+		url: conf.ObjectDetectionURL,
+		client: &http.Client{
+			Timeout: time.Duration(conf.ObjectDetectionTimeout) * time.Second,
+		},
+	}
+
+	objectDetectionEnabled = true
+}
+
+func (d *httpObjectDetector) detect(data []byte, imgtype imageType) ([]detectedObject, error) {
+	req, err := http.NewRequest("POST", d.url, bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("Can't create object detection request: %s", err)
+	}
+
+	req.Header.Set("Content-Type", mimes[imgtype])
+	req.Header.Set("User-Agent", conf.UserAgent)
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Can't detect objects: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		body, _ := ioutil.ReadAll(res.Body)
+		return nil, fmt.Errorf("Can't detect objects; Status: %d; %s", res.StatusCode, string(body))
+	}
+
+	var objects []detectedObject
+
+	if err := json.NewDecoder(res.Body).Decode(&objects); err != nil {
+		return nil, fmt.Errorf("Can't parse detected objects: %s", err)
+	}
+
+	return objects, nil
+}
+
+// detectObjects detects objects on the image. Detection errors shouldn't break processing,
+// so we just log them and return nil which means center gravity
+func detectObjects(data []byte, imgtype imageType, width, height int) *detectedObjects {
+	objects, err := objectDetectionBackend.detect(data, imgtype)
+	if err != nil {
+		warning("%s; falling back to center gravity", err)
+		return nil
+	}
+
+	return &detectedObjects{width: width, height: height, objects: objects}
+}
+
+func calcObjectsCrop(width, height, cropWidth, cropHeight int, detected *detectedObjects, classes []string) (left, top int) {
+	if detected == nil || detected.width <= 0 || detected.height <= 0 {
+		return calcCrop(width, height, cropWidth, cropHeight, &gravityOptions{Type: gravityCenter})
+	}
+
+	found := false
+	minX, minY := math.MaxFloat64, math.MaxFloat64
+	maxX, maxY := 0.0, 0.0
+
+	for _, obj := range detected.objects {
+		if obj.Confidence < conf.ObjectDetectionConfidence || !containsString(classes, obj.Class) {
+			continue
+		}
+
+		found = true
+
+		minX = math.Min(minX, obj.X)
+		minY = math.Min(minY, obj.Y)
+		maxX = math.Max(maxX, obj.X+obj.Width)
+		maxY = math.Max(maxY, obj.Y+obj.Height)
+	}
+
+	if !found {
+		return calcCrop(width, height, cropWidth, cropHeight, &gravityOptions{Type: gravityCenter})
+	}
+
+	// Crop around the center of the area that contains all the found objects.
+	// Objects could be detected on the image of another size, so we use relative coordinates
+	gravity := gravityOptions{
+		Type: gravityFocusPoint,
+		X:    math.Max(0, math.Min((minX+maxX)/2/float64(detected.width), 1)),
+		Y:    math.Max(0, math.Min((minY+maxY)/2/float64(detected.height), 1)),
+	}
+
+	return calcCrop(width, height, cropWidth, cropHeight, &gravity)
+}
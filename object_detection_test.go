@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type ObjectDetectionTestSuite struct{ MainTestSuite }
+
+type failingObjectDetector struct{}
+
+func (d failingObjectDetector) detect(data []byte, imgtype imageType) ([]detectedObject, error) {
+	return nil, errors.New("Can't detect objects: timeout")
+}
+
+func (s *ObjectDetectionTestSuite) TestDetectObjectsFailure() {
+	oldBackend := objectDetectionBackend
+	defer func() { objectDetectionBackend = oldBackend }()
+
+	objectDetectionBackend = failingObjectDetector{}
+
+	assert.Nil(s.T(), detectObjects([]byte("test"), imageTypeJPEG, 100, 100))
+}
+
+func (s *ObjectDetectionTestSuite) TestCalcObjectsCropUnion() {
+	detected := &detectedObjects{
+		width:  100,
+		height: 100,
+		objects: []detectedObject{
+			{Class: "face", Confidence: 0.9, X: 0, Y: 0, Width: 20, Height: 20},
+			{Class: "car", Confidence: 0.9, X: 40, Y: 60, Width: 20, Height: 20},
+			{Class: "dog", Confidence: 0.9, X: 80, Y: 80, Width: 20, Height: 20},
+		},
+	}
+
+	// The area of face and car is (0, 0) - (60, 80), its center is (30, 40)
+	left, top := calcObjectsCrop(100, 100, 20, 20, detected, []string{"face", "car"})
+
+	assert.Equal(s.T(), 20, left)
+	assert.Equal(s.T(), 30, top)
+}
+
+func (s *ObjectDetectionTestSuite) TestCalcObjectsCropRelative() {
+	detected := &detectedObjects{
+		width:  100,
+		height: 100,
+		objects: []detectedObject{
+			{Class: "face", Confidence: 0.9, X: 20, Y: 30, Width: 20, Height: 20},
+		},
+	}
+
+	// Objects were detected on the image that is twice as small
+	left, top := calcObjectsCrop(200, 200, 40, 40, detected, []string{"face"})
+
+	assert.Equal(s.T(), 40, left)
+	assert.Equal(s.T(), 60, top)
+}
+
+func (s *ObjectDetectionTestSuite) TestCalcObjectsCropConfidence() {
+	conf.ObjectDetectionConfidence = 0.5
+
+	detected := &detectedObjects{
+		width:  100,
+		height: 100,
+		objects: []detectedObject{
+			{Class: "face", Confidence: 0.4, X: 0, Y: 0, Width: 20, Height: 20},
+			{Class: "face", Confidence: 0.6, X: 60, Y: 60, Width: 20, Height: 20},
+		},
+	}
+
+	left, top := calcObjectsCrop(100, 100, 20, 20, detected, []string{"face"})
+
+	assert.Equal(s.T(), 60, left)
+	assert.Equal(s.T(), 60, top)
+}
+
+func (s *ObjectDetectionTestSuite) TestCalcObjectsCropNoMatch() {
+	detected := &detectedObjects{
+		width:  100,
+		height: 100,
+		objects: []detectedObject{
+			{Class: "car", Confidence: 0.9, X: 0, Y: 0, Width: 20, Height: 20},
+		},
+	}
+
+	left, top := calcObjectsCrop(100, 100, 20, 20, detected, []string{"face"})
+
+	assert.Equal(s.T(), 40, left)
+	assert.Equal(s.T(), 40, top)
+}
+
+func (s *ObjectDetectionTestSuite) TestCalcObjectsCropNotDetected() {
+	left, top := calcObjectsCrop(100, 100, 20, 20, nil, []string{"face"})
+
+	assert.Equal(s.T(), 40, left)
+	assert.Equal(s.T(), 40, top)
+}
+
+func (s *ObjectDetectionTestSuite) TestCalcObjectsCropClamp() {
+	detected := &detectedObjects{
+		width:  100,
+		height: 100,
+		objects: []detectedObject{
+			{Class: "face", Confidence: 0.9, X: 90, Y: 95, Width: 30, Height: 30},
+		},
+	}
+
+	left, top := calcObjectsCrop(100, 100, 40, 40, detected, []string{"face"})
+
+	assert.Equal(s.T(), 60, left)
+	assert.Equal(s.T(), 60, top)
+}
+
+func TestObjectDetection(t *testing.T) {
+	suite.Run(t, new(ObjectDetectionTestSuite))
+}
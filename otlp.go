@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OTLP aggregation temporality: values are accumulated since otlpStartTime
+const otlpAggregationTemporalityCumulative = 2
+
+var (
+	otlpEnabled = false
+
+	otlpClient    *http.Client
+	otlpStartTime time.Time
+	otlpStop      chan struct{}
+
+	otlpRequestsTotal      *otlpCounter
+	otlpErrorsTotal        *otlpCounter
+	otlpRequestDuration    *otlpHistogram
+	otlpDownloadDuration   *otlpHistogram
+	otlpProcessingDuration *otlpHistogram
+
+	otlpTraceCtxKey = ctxKey("otlpTrace")
+
+	// Same buckets as Prometheus client uses by default
+	otlpDefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+)
+
+type otlpTrace struct {
+	TraceID string
+	SpanID  string
+}
+
+type otlpCounter struct {
+	name        string
+	description string
+	attrKey     string
+
+	mutex  sync.Mutex
+	values map[string]int64
+}
+
+type otlpExemplar struct {
+	value float64
+	time  time.Time
+	trace *otlpTrace
+}
+
+type otlpHistogram struct {
+	name        string
+	description string
+	bounds      []float64
+
+	mutex     sync.Mutex
+	counts    []uint64
+	sum       float64
+	count     uint64
+	exemplars []*otlpExemplar
+}
+
+func newOTLPCounter(name, description, attrKey string) *otlpCounter {
+	return &otlpCounter{
+		name:        name,
+		description: description,
+		attrKey:     attrKey,
+		values:      make(map[string]int64),
+	}
+}
+
+func (c *otlpCounter) inc(attrValue string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.values[attrValue]++
+}
+
+func newOTLPHistogram(name, description string, bounds []float64) *otlpHistogram {
+	return &otlpHistogram{
+		name:        name,
+		description: description,
+		bounds:      bounds,
+		counts:      make([]uint64, len(bounds)+1),
+		exemplars:   make([]*otlpExemplar, len(bounds)+1),
+	}
+}
+
+func (h *otlpHistogram) observe(v float64, trace *otlpTrace) {
+	// Bucket i contains values that are greater than bounds[i-1] and less than or equal to bounds[i]
+	i := sort.SearchFloat64s(h.bounds, v)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.counts[i]++
+	h.sum += v
+	h.count++
+
+	// Keep the last traced observation of the bucket so it can be linked to the trace
+	if trace != nil {
+		h.exemplars[i] = &otlpExemplar{value: v, time: time.Now(), trace: trace}
+	}
+}
+
+func initOTLP() {
+	if len(conf.OTLPEndpoint) == 0 {
+		return
+	}
+
+	otlpRequestsTotal = newOTLPCounter("requests_total", "A counter of the total number of HTTP requests imgproxy processed.", "")
+	otlpErrorsTotal = newOTLPCounter("errors_total", "A counter of the occured errors separated by type.", "type")
+	otlpRequestDuration = newOTLPHistogram("request_duration_seconds", "A histogram of the response latency.", otlpDefaultBuckets)
+	otlpDownloadDuration = newOTLPHistogram("download_duration_seconds", "A histogram of the source image downloading latency.", otlpDefaultBuckets)
+	otlpProcessingDuration = newOTLPHistogram("processing_duration_seconds", "A histogram of the image processing latency.", otlpDefaultBuckets)
+
+	interval := time.Duration(conf.OTLPPushInterval) * time.Second
+
+	otlpClient = &http.Client{Timeout: interval}
+	otlpStartTime = time.Now()
+	otlpStop = make(chan struct{})
+
+	otlpEnabled = true
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := pushOTLPMetrics(); err != nil {
+					warning("Can't push OTLP metrics: %s", err)
+				}
+			case <-otlpStop:
+				return
+			}
+		}
+	}()
+
+	log.Printf("Pushing OTLP metrics to %s every %s\n", otlpMetricsURL(), interval)
+}
+
+func shutdownOTLP() {
+	if !otlpEnabled {
+		return
+	}
+
+	close(otlpStop)
+
+	// Push the metrics collected since the last push
+	if err := pushOTLPMetrics(); err != nil {
+		warning("Can't push OTLP metrics: %s", err)
+	}
+}
+
+// parseTraceParent parses W3C Trace Context traceparent header
+func parseTraceParent(header string) *otlpTrace {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return nil
+	}
+
+	traceID, spanID := strings.ToLower(parts[1]), strings.ToLower(parts[2])
+
+	if len(traceID) != 32 || len(spanID) != 16 {
+		return nil
+	}
+
+	if _, err := hex.DecodeString(traceID + spanID); err != nil {
+		return nil
+	}
+
+	if strings.Trim(traceID, "0") == "" || strings.Trim(spanID, "0") == "" {
+		return nil
+	}
+
+	return &otlpTrace{TraceID: traceID, SpanID: spanID}
+}
+
+func startOTLPRequest(ctx context.Context, r *http.Request) context.Context {
+	otlpRequestsTotal.inc("")
+
+	if trace := parseTraceParent(r.Header.Get("traceparent")); trace != nil {
+		return context.WithValue(ctx, otlpTraceCtxKey, trace)
+	}
+
+	return ctx
+}
+
+func startOTLPDuration(ctx context.Context, h *otlpHistogram) func() {
+	t := time.Now()
+	trace, _ := ctx.Value(otlpTraceCtxKey).(*otlpTrace)
+
+	return func() {
+		h.observe(time.Since(t).Seconds(), trace)
+	}
+}
+
+func incrementOTLPErrorsTotal(t string) {
+	otlpErrorsTotal.inc(t)
+}
+
+// OTLP/HTTP JSON payload. 64-bit integers are encoded as strings
+// and trace/span IDs are encoded as hex strings as the protocol requires
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpNumberDataPoint struct {
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	TimeUnixNano      string         `json:"timeUnixNano"`
+	AsInt             string         `json:"asInt"`
+}
+
+type otlpExemplarJSON struct {
+	TimeUnixNano string  `json:"timeUnixNano"`
+	AsDouble     float64 `json:"asDouble"`
+	TraceID      string  `json:"traceId"`
+	SpanID       string  `json:"spanId"`
+}
+
+type otlpHistogramDataPoint struct {
+	StartTimeUnixNano string             `json:"startTimeUnixNano"`
+	TimeUnixNano      string             `json:"timeUnixNano"`
+	Count             string             `json:"count"`
+	Sum               float64            `json:"sum"`
+	BucketCounts      []string           `json:"bucketCounts"`
+	ExplicitBounds    []float64          `json:"explicitBounds"`
+	Exemplars         []otlpExemplarJSON `json:"exemplars,omitempty"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpNumberDataPoint `json:"dataPoints"`
+	AggregationTemporality int                   `json:"aggregationTemporality"`
+	IsMonotonic            bool                  `json:"isMonotonic"`
+}
+
+type otlpHistogramJSON struct {
+	DataPoints             []otlpHistogramDataPoint `json:"dataPoints"`
+	AggregationTemporality int                      `json:"aggregationTemporality"`
+}
+
+type otlpMetric struct {
+	Name        string             `json:"name"`
+	Description string             `json:"description"`
+	Unit        string             `json:"unit"`
+	Sum         *otlpSum           `json:"sum,omitempty"`
+	Histogram   *otlpHistogramJSON `json:"histogram,omitempty"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpMetricsRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+func otlpUnixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func (c *otlpCounter) export(now time.Time) otlpMetric {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	points := make([]otlpNumberDataPoint, 0, len(c.values))
+
+	for attrValue, v := range c.values {
+		point := otlpNumberDataPoint{
+			StartTimeUnixNano: otlpUnixNano(otlpStartTime),
+			TimeUnixNano:      otlpUnixNano(now),
+			AsInt:             strconv.FormatInt(v, 10),
+		}
+
+		if len(c.attrKey) > 0 {
+			point.Attributes = []otlpKeyValue{{Key: c.attrKey, Value: otlpAnyValue{attrValue}}}
+		}
+
+		points = append(points, point)
+	}
+
+	return otlpMetric{
+		Name:        c.name,
+		Description: c.description,
+		Unit:        "1",
+		Sum: &otlpSum{
+			DataPoints:             points,
+			AggregationTemporality: otlpAggregationTemporalityCumulative,
+			IsMonotonic:            true,
+		},
+	}
+}
+
+func (h *otlpHistogram) export(now time.Time) otlpMetric {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	point := otlpHistogramDataPoint{
+		StartTimeUnixNano: otlpUnixNano(otlpStartTime),
+		TimeUnixNano:      otlpUnixNano(now),
+		Count:             strconv.FormatUint(h.count, 10),
+		Sum:               h.sum,
+		BucketCounts:      make([]string, len(h.counts)),
+		ExplicitBounds:    h.bounds,
+	}
+
+	for i, c := range h.counts {
+		point.BucketCounts[i] = strconv.FormatUint(c, 10)
+	}
+
+	for _, e := range h.exemplars {
+		if e == nil {
+			continue
+		}
+
+		point.Exemplars = append(point.Exemplars, otlpExemplarJSON{
+			TimeUnixNano: otlpUnixNano(e.time),
+			AsDouble:     e.value,
+			TraceID:      e.trace.TraceID,
+			SpanID:       e.trace.SpanID,
+		})
+	}
+
+	return otlpMetric{
+		Name:        h.name,
+		Description: h.description,
+		Unit:        "s",
+		Histogram: &otlpHistogramJSON{
+			DataPoints:             []otlpHistogramDataPoint{point},
+			AggregationTemporality: otlpAggregationTemporalityCumulative,
+		},
+	}
+}
+
+func otlpMetricsURL() string {
+	return strings.TrimRight(conf.OTLPEndpoint, "/") + "/v1/metrics"
+}
+
+func collectOTLPMetrics(now time.Time) otlpMetricsRequest {
+	return otlpMetricsRequest{
+		ResourceMetrics: []otlpResourceMetrics{{
+			Resource: otlpResource{
+				Attributes: []otlpKeyValue{
+					{Key: "service.name", Value: otlpAnyValue{conf.OTLPServiceName}},
+					{Key: "service.version", Value: otlpAnyValue{version}},
+				},
+			},
+			ScopeMetrics: []otlpScopeMetrics{{
+				Scope: otlpScope{Name: "imgproxy", Version: version},
+				Metrics: []otlpMetric{
+					otlpRequestsTotal.export(now),
+					otlpErrorsTotal.export(now),
+					otlpRequestDuration.export(now),
+					otlpDownloadDuration.export(now),
+					otlpProcessingDuration.export(now),
+				},
+			}},
+		}},
+	}
+}
+
+func pushOTLPMetrics() error {
+	body, err := json.Marshal(collectOTLPMetrics(time.Now()))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", otlpMetricsURL(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", conf.UserAgent)
+
+	res, err := otlpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("Status: %d; %s", res.StatusCode, string(msg))
+	}
+
+	return nil
+}
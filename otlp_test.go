@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type OTLPTestSuite struct{ MainTestSuite }
+
+func (s *OTLPTestSuite) SetupTest() {
+	s.MainTestSuite.SetupTest()
+
+	otlpRequestsTotal = newOTLPCounter("requests_total", "", "")
+	otlpErrorsTotal = newOTLPCounter("errors_total", "", "type")
+	otlpRequestDuration = newOTLPHistogram("request_duration_seconds", "", otlpDefaultBuckets)
+	otlpDownloadDuration = newOTLPHistogram("download_duration_seconds", "", otlpDefaultBuckets)
+	otlpProcessingDuration = newOTLPHistogram("processing_duration_seconds", "", otlpDefaultBuckets)
+
+	otlpClient = &http.Client{Timeout: time.Second}
+	otlpStartTime = time.Now()
+}
+
+func (s *OTLPTestSuite) TestParseTraceParent() {
+	trace := parseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	require.NotNil(s.T(), trace)
+	assert.Equal(s.T(), "4bf92f3577b34da6a3ce929d0e0e4736", trace.TraceID)
+	assert.Equal(s.T(), "00f067aa0ba902b7", trace.SpanID)
+}
+
+func (s *OTLPTestSuite) TestParseTraceParentInvalid() {
+	assert.Nil(s.T(), parseTraceParent(""))
+	assert.Nil(s.T(), parseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-01"))
+	assert.Nil(s.T(), parseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e47zz-00f067aa0ba902b7-01"))
+	assert.Nil(s.T(), parseTraceParent("00-00000000000000000000000000000000-00f067aa0ba902b7-01"))
+	assert.Nil(s.T(), parseTraceParent("ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"))
+}
+
+func (s *OTLPTestSuite) TestHistogramObserve() {
+	h := newOTLPHistogram("test", "", []float64{1, 2})
+	trace := &otlpTrace{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7"}
+
+	h.observe(0.5, nil)
+	h.observe(1, trace)
+	h.observe(3, nil)
+
+	assert.Equal(s.T(), []uint64{2, 0, 1}, h.counts)
+	assert.Equal(s.T(), uint64(3), h.count)
+	assert.Equal(s.T(), 4.5, h.sum)
+
+	require.NotNil(s.T(), h.exemplars[0])
+	assert.Equal(s.T(), 1.0, h.exemplars[0].value)
+	assert.Equal(s.T(), trace, h.exemplars[0].trace)
+	assert.Nil(s.T(), h.exemplars[2])
+}
+
+func (s *OTLPTestSuite) TestPushMetrics() {
+	var payload map[string]interface{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		assert.Equal(s.T(), "/v1/metrics", r.URL.Path)
+		assert.Equal(s.T(), "application/json", r.Header.Get("Content-Type"))
+
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &payload)
+
+		rw.WriteHeader(200)
+	}))
+	defer server.Close()
+
+	conf.OTLPEndpoint = server.URL + "/"
+
+	otlpRequestsTotal.inc("")
+	incrementOTLPErrorsTotal("timeout")
+	otlpRequestDuration.observe(0.3, &otlpTrace{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7"})
+
+	require.Nil(s.T(), pushOTLPMetrics())
+	require.NotNil(s.T(), payload)
+
+	metrics := payload["resourceMetrics"].([]interface{})[0].(map[string]interface{})["scopeMetrics"].([]interface{})[0].(map[string]interface{})["metrics"].([]interface{})
+	require.Len(s.T(), metrics, 5)
+
+	requests := metrics[0].(map[string]interface{})
+	assert.Equal(s.T(), "requests_total", requests["name"])
+	assert.Equal(s.T(), "1", requests["sum"].(map[string]interface{})["dataPoints"].([]interface{})[0].(map[string]interface{})["asInt"])
+
+	duration := metrics[2].(map[string]interface{})
+	point := duration["histogram"].(map[string]interface{})["dataPoints"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(s.T(), "1", point["count"])
+
+	exemplar := point["exemplars"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(s.T(), "4bf92f3577b34da6a3ce929d0e0e4736", exemplar["traceId"])
+}
+
+// TestMetricsPayload checks the payload against OTLP/HTTP JSON encoding of
+// opentelemetry.proto.collector.metrics.v1.ExportMetricsServiceRequest: field names are
+// lowerCamelCase, (s)fixed64 fields are strings, enums are integers, and trace/span IDs are hex strings
+func (s *OTLPTestSuite) TestMetricsPayload() {
+	otlpStartTime = time.Unix(1600000000, 0)
+	now := time.Unix(1600000010, 0)
+
+	otlpRequestDuration = newOTLPHistogram("request_duration_seconds", "A histogram of the response latency.", []float64{0.5, 1})
+
+	otlpRequestsTotal.inc("")
+	otlpRequestsTotal.inc("")
+	otlpErrorsTotal.inc("timeout")
+	otlpRequestDuration.observe(0.25, nil)
+	otlpRequestDuration.observe(0.75, &otlpTrace{TraceID: "4bf92f3577b34da6a3ce929d0e0e4736", SpanID: "00f067aa0ba902b7"})
+	otlpRequestDuration.exemplars[1].time = time.Unix(1600000005, 0)
+
+	payload := collectOTLPMetrics(now)
+
+	// Only the metrics we set up above are checked
+	payload.ResourceMetrics[0].ScopeMetrics[0].Metrics = payload.ResourceMetrics[0].ScopeMetrics[0].Metrics[:3]
+
+	body, err := json.Marshal(payload)
+	require.Nil(s.T(), err)
+
+	assert.JSONEq(s.T(), `{
+		"resourceMetrics": [{
+			"resource": {
+				"attributes": [
+					{"key": "service.name", "value": {"stringValue": "imgproxy"}},
+					{"key": "service.version", "value": {"stringValue": "`+version+`"}}
+				]
+			},
+			"scopeMetrics": [{
+				"scope": {"name": "imgproxy", "version": "`+version+`"},
+				"metrics": [
+					{
+						"name": "requests_total",
+						"description": "",
+						"unit": "1",
+						"sum": {
+							"dataPoints": [{
+								"startTimeUnixNano": "1600000000000000000",
+								"timeUnixNano": "1600000010000000000",
+								"asInt": "2"
+							}],
+							"aggregationTemporality": 2,
+							"isMonotonic": true
+						}
+					},
+					{
+						"name": "errors_total",
+						"description": "",
+						"unit": "1",
+						"sum": {
+							"dataPoints": [{
+								"attributes": [{"key": "type", "value": {"stringValue": "timeout"}}],
+								"startTimeUnixNano": "1600000000000000000",
+								"timeUnixNano": "1600000010000000000",
+								"asInt": "1"
+							}],
+							"aggregationTemporality": 2,
+							"isMonotonic": true
+						}
+					},
+					{
+						"name": "request_duration_seconds",
+						"description": "A histogram of the response latency.",
+						"unit": "s",
+						"histogram": {
+							"dataPoints": [{
+								"startTimeUnixNano": "1600000000000000000",
+								"timeUnixNano": "1600000010000000000",
+								"count": "2",
+								"sum": 1,
+								"bucketCounts": ["1", "1", "0"],
+								"explicitBounds": [0.5, 1],
+								"exemplars": [{
+									"timeUnixNano": "1600000005000000000",
+									"asDouble": 0.75,
+									"traceId": "4bf92f3577b34da6a3ce929d0e0e4736",
+									"spanId": "00f067aa0ba902b7"
+								}]
+							}],
+							"aggregationTemporality": 2
+						}
+					}
+				]
+			}]
+		}]
+	}`, string(body))
+}
+
+func (s *OTLPTestSuite) TestPushMetricsError() {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(500)
+	}))
+	defer server.Close()
+
+	conf.OTLPEndpoint = server.URL
+
+	assert.Error(s.T(), pushOTLPMetrics())
+}
+
+func TestOTLP(t *testing.T) {
+	suite.Run(t, new(OTLPTestSuite))
+}
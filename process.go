@@ -272,7 +272,7 @@ func resizeImage(img **C.struct__VipsImage, scale float64, hasAlpha bool) error
 	return nil
 }
 
-func transformImage(ctx context.Context, img **C.struct__VipsImage, data []byte, po *processingOptions, imgtype imageType) error {
+func transformImage(ctx context.Context, img **C.struct__VipsImage, data []byte, po *processingOptions, imgtype imageType, wm *C.struct__VipsImage) error {
 	var err error
 
 	imgWidth, imgHeight, angle, flip := extractMeta(*img)
@@ -368,6 +368,19 @@ func transformImage(ctx context.Context, img **C.struct__VipsImage, data []byte,
 			if err = vipsImageCopyMemory(img); err != nil {
 				return err
 			}
+		} else if po.Gravity.Type == gravityObject {
+			// Animated images have objects detected once for all the frames
+			detected, ok := ctx.Value(detectedObjectsCtxKey).(*detectedObjects)
+			if !ok {
+				if detected, err = vipsDetectObjects(*img); err != nil {
+					return err
+				}
+			}
+
+			left, top := calcObjectsCrop(imgWidth, imgHeight, cropW, cropH, detected, po.Gravity.Classes)
+			if err = vipsCrop(img, left, top, cropW, cropH); err != nil {
+				return err
+			}
 		} else {
 			left, top := calcCrop(imgWidth, imgHeight, cropW, cropH, &po.Gravity)
 			if err = vipsCrop(img, left, top, cropW, cropH); err != nil {
@@ -409,7 +422,7 @@ func transformImage(ctx context.Context, img **C.struct__VipsImage, data []byte,
 	checkTimeout(ctx)
 
 	if po.Watermark.Enabled {
-		if err = vipsApplyWatermark(img, &po.Watermark); err != nil {
+		if err = vipsApplyWatermark(img, wm, &po.Watermark); err != nil {
 			return err
 		}
 	}
@@ -421,12 +434,14 @@ func transformImage(ctx context.Context, img **C.struct__VipsImage, data []byte,
 	return nil
 }
 
-func transformGif(ctx context.Context, img **C.struct__VipsImage, po *processingOptions) error {
+func transformGif(ctx context.Context, img **C.struct__VipsImage, po *processingOptions, wm *C.struct__VipsImage) error {
 	imgWidth := int((*img).Xsize)
 	imgHeight := int((*img).Ysize)
 
+	hc := sourceHostConfigFor(getImageURL(ctx))
+
 	// Double check dimensions because gif may have many frames
-	if err := checkDimensions(imgWidth, imgHeight); err != nil {
+	if err := checkDimensions(imgWidth, imgHeight, hc); err != nil {
 		return err
 	}
 
@@ -445,7 +460,7 @@ func transformGif(ctx context.Context, img **C.struct__VipsImage, po *processing
 		return err
 	}
 
-	framesCount := minInt(imgHeight/frameHeight, conf.MaxGifFrames)
+	framesCount := minInt(imgHeight/frameHeight, hc.MaxGifFrames)
 
 	frames := make([]*C.struct__VipsImage, framesCount)
 	defer func() {
@@ -454,6 +469,25 @@ func transformGif(ctx context.Context, img **C.struct__VipsImage, po *processing
 		}
 	}()
 
+	if po.Gravity.Type == gravityObject {
+		// Detect objects on the first frame only so all the frames are cropped the same way
+		// and we don't send a detection request per frame
+		var frame *C.struct__VipsImage
+
+		if err := vipsExtract(*img, &frame, 0, 0, imgWidth, frameHeight); err != nil {
+			return err
+		}
+
+		detected, err := vipsDetectObjects(frame)
+		C.clear_image(&frame)
+
+		if err != nil {
+			return err
+		}
+
+		ctx = context.WithValue(ctx, detectedObjectsCtxKey, detected)
+	}
+
 	var errg errgroup.Group
 
 	for i := 0; i < framesCount; i++ {
@@ -465,7 +499,7 @@ func transformGif(ctx context.Context, img **C.struct__VipsImage, po *processing
 				return err
 			}
 
-			if err := transformImage(ctx, &frame, nil, po, imageTypeGIF); err != nil {
+			if err := transformImage(ctx, &frame, nil, po, imageTypeGIF, wm); err != nil {
 				return err
 			}
 
@@ -505,6 +539,10 @@ func processImage(ctx context.Context) ([]byte, error) {
 		defer startPrometheusDuration(prometheusProcessingDuration)()
 	}
 
+	if otlpEnabled {
+		defer startOTLPDuration(ctx, otlpProcessingDuration)()
+	}
+
 	defer C.vips_cleanup()
 
 	po := getProcessingOptions(ctx)
@@ -515,6 +553,10 @@ func processImage(ctx context.Context) ([]byte, error) {
 		return nil, errSmartCropNotSupported
 	}
 
+	if po.Gravity.Type == gravityObject && !objectDetectionEnabled {
+		return nil, errObjectDetectionNotConfigured
+	}
+
 	if po.Format == imageTypeUnknown {
 		if vipsTypeSupportSave[imgtype] {
 			po.Format = imgtype
@@ -523,6 +565,16 @@ func processImage(ctx context.Context) ([]byte, error) {
 		}
 	}
 
+	wm := watermark
+
+	if po.Watermark.Enabled && len(po.Watermark.URL) > 0 {
+		var err error
+		if wm, err = vipsLoadRemoteWatermark(po.Watermark.URL); err != nil {
+			return nil, err
+		}
+		defer C.clear_image(&wm)
+	}
+
 	img, err := vipsLoadImage(data, imgtype, 1, 1.0, po.Format == imageTypeGIF)
 	if err != nil {
 		return nil, err
@@ -530,11 +582,11 @@ func processImage(ctx context.Context) ([]byte, error) {
 	defer C.clear_image(&img)
 
 	if imgtype == imageTypeGIF && po.Format == imageTypeGIF && vipsIsAnimatedGif(img) {
-		if err := transformGif(ctx, &img, po); err != nil {
+		if err := transformGif(ctx, &img, po, wm); err != nil {
 			return nil, err
 		}
 	} else {
-		if err := transformImage(ctx, &img, data, po, imgtype); err != nil {
+		if err := transformImage(ctx, &img, data, po, imgtype, wm); err != nil {
 			return nil, err
 		}
 	}
@@ -563,51 +615,71 @@ func vipsPrepareWatermark() error {
 		return nil
 	}
 
-	watermark, err = vipsLoadImage(data, imgtype, 1, 1.0, false)
+	watermark, err = vipsLoadWatermark(data, imgtype)
+
+	return err
+}
+
+func vipsLoadRemoteWatermark(url string) (*C.struct__VipsImage, error) {
+	data, imgtype, err := cachedRemoteWatermarkData(url)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	return vipsLoadWatermark(data, imgtype)
+}
+
+func vipsLoadWatermark(data []byte, imgtype imageType) (wm *C.struct__VipsImage, err error) {
+	if wm, err = vipsLoadImage(data, imgtype, 1, 1.0, false); err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if err != nil {
+			C.clear_image(&wm)
+		}
+	}()
+
 	var tmp *C.struct__VipsImage
 
 	if cConf.WatermarkOpacity < 1 {
-		if vipsImageHasAlpha(watermark) {
+		if vipsImageHasAlpha(wm) {
 			var alpha *C.struct__VipsImage
 			defer C.clear_image(&alpha)
 
-			if C.vips_extract_band_go(watermark, &tmp, (*watermark).Bands-1, 1) != 0 {
-				return vipsError()
+			if C.vips_extract_band_go(wm, &tmp, (*wm).Bands-1, 1) != 0 {
+				return wm, vipsError()
 			}
 			C.swap_and_clear(&alpha, tmp)
 
-			if C.vips_extract_band_go(watermark, &tmp, 0, (*watermark).Bands-1) != 0 {
-				return vipsError()
+			if C.vips_extract_band_go(wm, &tmp, 0, (*wm).Bands-1) != 0 {
+				return wm, vipsError()
 			}
-			C.swap_and_clear(&watermark, tmp)
+			C.swap_and_clear(&wm, tmp)
 
 			if C.vips_linear_go(alpha, &tmp, cConf.WatermarkOpacity, 0) != 0 {
-				return vipsError()
+				return wm, vipsError()
 			}
 			C.swap_and_clear(&alpha, tmp)
 
-			if C.vips_bandjoin_go(watermark, alpha, &tmp) != 0 {
-				return vipsError()
+			if C.vips_bandjoin_go(wm, alpha, &tmp) != 0 {
+				return wm, vipsError()
 			}
-			C.swap_and_clear(&watermark, tmp)
+			C.swap_and_clear(&wm, tmp)
 		} else {
-			if C.vips_bandjoin_const_go(watermark, &tmp, cConf.WatermarkOpacity*255) != 0 {
-				return vipsError()
+			if C.vips_bandjoin_const_go(wm, &tmp, cConf.WatermarkOpacity*255) != 0 {
+				return wm, vipsError()
 			}
-			C.swap_and_clear(&watermark, tmp)
+			C.swap_and_clear(&wm, tmp)
 		}
 	}
 
-	if tmp = C.vips_image_copy_memory(watermark); tmp == nil {
-		return vipsError()
+	if tmp = C.vips_image_copy_memory(wm); tmp == nil {
+		return wm, vipsError()
 	}
-	C.swap_and_clear(&watermark, tmp)
+	C.swap_and_clear(&wm, tmp)
 
-	return nil
+	return wm, nil
 }
 
 func vipsLoadImage(data []byte, imgtype imageType, shrink int, svgScale float64, allPages bool) (*C.struct__VipsImage, error) {
@@ -818,6 +890,37 @@ func vipsSmartCrop(img **C.struct__VipsImage, width, height int) error {
 	return nil
 }
 
+func vipsDetectObjects(img *C.struct__VipsImage) (*detectedObjects, error) {
+	var tmp *C.struct__VipsImage
+
+	// Object detector needs 8-bit sRGB image, so we prepare a copy of the image
+	// to leave the original one untouched
+	if tmp = C.vips_image_copy_memory(img); tmp == nil {
+		return nil, vipsError()
+	}
+	defer C.clear_image(&tmp)
+
+	if err := vipsFixColourspace(&tmp); err != nil {
+		return nil, err
+	}
+
+	if err := vipsCastUchar(&tmp); err != nil {
+		return nil, err
+	}
+
+	imgtype := imageTypeJPEG
+	if vipsImageHasAlpha(tmp) {
+		imgtype = imageTypePNG
+	}
+
+	data, err := vipsSaveImage(tmp, imgtype, 90)
+	if err != nil {
+		return nil, err
+	}
+
+	return detectObjects(data, imgtype, int(img.Xsize), int(img.Ysize)), nil
+}
+
 func vipsFlatten(img **C.struct__VipsImage, bg color) error {
 	var tmp *C.struct__VipsImage
 
@@ -954,9 +1057,9 @@ func vipsEmbed(img **C.struct__VipsImage, gravity gravityType, width, height C.i
 	return nil
 }
 
-func vipsResizeWatermark(width, height int) (wm *C.struct__VipsImage, err error) {
-	wmW := float64(watermark.Xsize)
-	wmH := float64(watermark.Ysize)
+func vipsResizeWatermark(wmImage *C.struct__VipsImage, width, height int) (wm *C.struct__VipsImage, err error) {
+	wmW := float64(wmImage.Xsize)
+	wmH := float64(wmImage.Ysize)
 
 	wr := float64(width) / wmW
 	hr := float64(height) / wmH
@@ -971,15 +1074,15 @@ func vipsResizeWatermark(width, height int) (wm *C.struct__VipsImage, err error)
 		scale = 1 / wmH
 	}
 
-	if C.vips_resize_go(watermark, &wm, C.double(scale)) != 0 {
+	if C.vips_resize_go(wmImage, &wm, C.double(scale)) != 0 {
 		err = vipsError()
 	}
 
 	return
 }
 
-func vipsApplyWatermark(img **C.struct__VipsImage, opts *watermarkOptions) error {
-	if watermark == nil {
+func vipsApplyWatermark(img **C.struct__VipsImage, wmImage *C.struct__VipsImage, opts *watermarkOptions) error {
+	if wmImage == nil {
 		return nil
 	}
 
@@ -993,14 +1096,14 @@ func vipsApplyWatermark(img **C.struct__VipsImage, opts *watermarkOptions) error
 	imgH := (*img).Ysize
 
 	if opts.Scale == 0 {
-		if wm = C.vips_image_copy_memory(watermark); wm == nil {
+		if wm = C.vips_image_copy_memory(wmImage); wm == nil {
 			return vipsError()
 		}
 	} else {
 		wmW := maxInt(int(float64(imgW)*opts.Scale), 1)
 		wmH := maxInt(int(float64(imgH)*opts.Scale), 1)
 
-		if wm, err = vipsResizeWatermark(wmW, wmH); err != nil {
+		if wm, err = vipsResizeWatermark(wmImage, wmW, wmH); err != nil {
 			return err
 		}
 	}
@@ -63,6 +63,7 @@ const (
 	gravitySouthEast
 	gravitySmart
 	gravityFocusPoint
+	gravityObject
 )
 
 var gravityTypes = map[string]gravityType{
@@ -77,11 +78,13 @@ var gravityTypes = map[string]gravityType{
 	"soea": gravitySouthEast,
 	"sm":   gravitySmart,
 	"fp":   gravityFocusPoint,
+	"obj":  gravityObject,
 }
 
 type gravityOptions struct {
-	Type gravityType
-	X, Y float64
+	Type    gravityType
+	X, Y    float64
+	Classes []string
 }
 
 type resizeType int
@@ -115,6 +118,7 @@ type watermarkOptions struct {
 	OffsetX   int
 	OffsetY   int
 	Scale     float64
+	URL       string
 }
 
 type processingOptions struct {
@@ -133,11 +137,60 @@ type processingOptions struct {
 
 	CacheBuster string
 
+	BaseURL string
+
+	// Timeout doesn't affect the result, so it's not a part of ETag and result cache key
+	Timeout int `json:"-"`
+
 	Watermark watermarkOptions
 
 	UsedPresets []string
 }
 
+// Processing options that are used in basic URL format
+var basicProcessingOptions = []string{"resizing_type", "width", "height", "gravity", "enlarge"}
+
+// processingOptionsNames maps processing options names and their aliases to the full names
+var processingOptionsNames = map[string]string{
+	"format":        "format",
+	"f":             "format",
+	"ext":           "format",
+	"resize":        "resize",
+	"rs":            "resize",
+	"resizing_type": "resizing_type",
+	"rt":            "resizing_type",
+	"size":          "size",
+	"s":             "size",
+	"width":         "width",
+	"w":             "width",
+	"height":        "height",
+	"h":             "height",
+	"enlarge":       "enlarge",
+	"el":            "enlarge",
+	"dpr":           "dpr",
+	"gravity":       "gravity",
+	"g":             "gravity",
+	"quality":       "quality",
+	"q":             "quality",
+	"background":    "background",
+	"bg":            "background",
+	"blur":          "blur",
+	"bl":            "blur",
+	"sharpen":       "sharpen",
+	"sh":            "sharpen",
+	"watermark":     "watermark",
+	"wm":            "watermark",
+	"watermark_url": "watermark_url",
+	"wmu":           "watermark_url",
+	"preset":        "preset",
+	"pr":            "preset",
+	"cachebuster":   "cachebuster",
+	"cb":            "cachebuster",
+	"base_url":      "base_url",
+	"bu":            "base_url",
+	"timeout":       "timeout",
+}
+
 type applyOptionFunc func(po *processingOptions, args []string) error
 
 const (
@@ -216,7 +269,16 @@ func colorFromHex(hexcolor string) (color, error) {
 	return c, nil
 }
 
-func decodeBase64URL(parts []string) (string, string, error) {
+func addBaseURL(baseURL, imageURL string) string {
+	// Data URLs contain the image itself, so it makes no sense to add base URL to them
+	if conf.AllowDataURLs && strings.HasPrefix(imageURL, "data:") {
+		return imageURL
+	}
+
+	return fmt.Sprintf("%s%s", baseURL, imageURL)
+}
+
+func decodeBase64URL(parts []string, baseURL string) (string, string, error) {
 	var format string
 
 	urlParts := strings.Split(strings.Join(parts, ""), ".")
@@ -234,7 +296,7 @@ func decodeBase64URL(parts []string) (string, string, error) {
 		return "", "", errInvalidURLEncoding
 	}
 
-	fullURL := fmt.Sprintf("%s%s", conf.BaseURL, string(imageURL))
+	fullURL := addBaseURL(baseURL, string(imageURL))
 
 	if _, err := url.ParseRequestURI(fullURL); err != nil {
 		return "", "", errInvalidImageURL
@@ -243,7 +305,7 @@ func decodeBase64URL(parts []string) (string, string, error) {
 	return fullURL, format, nil
 }
 
-func decodePlainURL(parts []string) (string, string, error) {
+func decodePlainURL(parts []string, baseURL string) (string, string, error) {
 	var format string
 
 	urlParts := strings.Split(strings.Join(parts, "/"), "@")
@@ -256,14 +318,14 @@ func decodePlainURL(parts []string) (string, string, error) {
 		format = urlParts[1]
 	}
 
-	fullURL := fmt.Sprintf("%s%s", conf.BaseURL, urlParts[0])
+	fullURL := addBaseURL(baseURL, urlParts[0])
 
 	if _, err := url.ParseRequestURI(fullURL); err == nil {
 		return fullURL, format, nil
 	}
 
 	if unescaped, err := url.PathUnescape(urlParts[0]); err == nil {
-		fullURL := fmt.Sprintf("%s%s", conf.BaseURL, unescaped)
+		fullURL := addBaseURL(baseURL, unescaped)
 		if _, err := url.ParseRequestURI(fullURL); err == nil {
 			return fullURL, format, nil
 		}
@@ -272,16 +334,16 @@ func decodePlainURL(parts []string) (string, string, error) {
 	return "", "", errInvalidImageURL
 }
 
-func decodeURL(parts []string) (string, string, error) {
+func decodeURL(parts []string, baseURL string) (string, string, error) {
 	if len(parts) == 0 {
 		return "", "", errInvalidURLEncoding
 	}
 
 	if parts[0] == urlTokenPlain && len(parts) > 1 {
-		return decodePlainURL(parts[1:])
+		return decodePlainURL(parts[1:], baseURL)
 	}
 
-	return decodeBase64URL(parts)
+	return decodeBase64URL(parts, baseURL)
 }
 
 func applyWidthOption(po *processingOptions, args []string) error {
@@ -419,6 +481,18 @@ func applyGravityOption(po *processingOptions, args []string) error {
 		} else {
 			return fmt.Errorf("Invalid gravity Y: %s", args[2])
 		}
+	} else if po.Gravity.Type == gravityObject {
+		if len(args) < 2 {
+			return fmt.Errorf("Invalid gravity arguments: %v", args)
+		}
+
+		for _, class := range args[1:] {
+			if len(class) == 0 {
+				return fmt.Errorf("Invalid gravity object class: %v", args)
+			}
+		}
+
+		po.Gravity.Classes = args[1:]
 	} else if len(args) > 1 {
 		return fmt.Errorf("Invalid gravity arguments: %v", args)
 	}
@@ -543,7 +617,7 @@ func applyWatermarkOption(po *processingOptions, args []string) error {
 	if len(args) > 1 && len(args[1]) > 0 {
 		if args[1] == "re" {
 			po.Watermark.Replicate = true
-		} else if g, ok := gravityTypes[args[1]]; ok && g != gravityFocusPoint && g != gravitySmart {
+		} else if g, ok := gravityTypes[args[1]]; ok && g != gravityFocusPoint && g != gravitySmart && g != gravityObject {
 			po.Watermark.Gravity = g
 		} else {
 			return fmt.Errorf("Invalid watermark position: %s", args[1])
@@ -577,6 +651,30 @@ func applyWatermarkOption(po *processingOptions, args []string) error {
 	return nil
 }
 
+func applyWatermarkURLOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid watermark url arguments: %v", args)
+	}
+
+	if len(args[0]) == 0 {
+		po.Watermark.URL = ""
+		return nil
+	}
+
+	wmURL, err := base64.RawURLEncoding.DecodeString(args[0])
+	if err != nil {
+		return fmt.Errorf("Invalid watermark url encoding: %s", args[0])
+	}
+
+	if _, err := url.ParseRequestURI(string(wmURL)); err != nil {
+		return fmt.Errorf("Invalid watermark url: %s", redactDataURL(string(wmURL)))
+	}
+
+	po.Watermark.URL = string(wmURL)
+
+	return nil
+}
+
 func applyFormatOption(po *processingOptions, args []string) error {
 	if len(args) > 1 {
 		return fmt.Errorf("Invalid format arguments: %v", args)
@@ -610,33 +708,64 @@ func applyCacheBusterOption(po *processingOptions, args []string) error {
 	return nil
 }
 
+func applyBaseURLOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid base url arguments: %v", args)
+	}
+
+	if len(args[0]) > 0 {
+		if _, ok := conf.BaseURLs[args[0]]; !ok {
+			return fmt.Errorf("Unknown base url: %s", args[0])
+		}
+	}
+
+	po.BaseURL = args[0]
+
+	return nil
+}
+
+func applyTimeoutOption(po *processingOptions, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid timeout arguments: %v", args)
+	}
+
+	if t, err := strconv.Atoi(args[0]); err == nil && t > 0 {
+		// Timeout can't exceed the configured maximum
+		po.Timeout = minInt(t, conf.MaxRequestTimeout)
+	} else {
+		return fmt.Errorf("Invalid timeout: %s", args[0])
+	}
+
+	return nil
+}
+
 func applyProcessingOption(po *processingOptions, name string, args []string) error {
-	switch name {
-	case "format", "f", "ext":
+	switch processingOptionsNames[name] {
+	case "format":
 		if err := applyFormatOption(po, args); err != nil {
 			return err
 		}
-	case "resize", "rs":
+	case "resize":
 		if err := applyResizeOption(po, args); err != nil {
 			return err
 		}
-	case "resizing_type", "rt":
+	case "resizing_type":
 		if err := applyResizingTypeOption(po, args); err != nil {
 			return err
 		}
-	case "size", "s":
+	case "size":
 		if err := applySizeOption(po, args); err != nil {
 			return err
 		}
-	case "width", "w":
+	case "width":
 		if err := applyWidthOption(po, args); err != nil {
 			return err
 		}
-	case "height", "h":
+	case "height":
 		if err := applyHeightOption(po, args); err != nil {
 			return err
 		}
-	case "enlarge", "el":
+	case "enlarge":
 		if err := applyEnlargeOption(po, args); err != nil {
 			return err
 		}
@@ -644,38 +773,50 @@ func applyProcessingOption(po *processingOptions, name string, args []string) er
 		if err := applyDprOption(po, args); err != nil {
 			return err
 		}
-	case "gravity", "g":
+	case "gravity":
 		if err := applyGravityOption(po, args); err != nil {
 			return err
 		}
-	case "quality", "q":
+	case "quality":
 		if err := applyQualityOption(po, args); err != nil {
 			return err
 		}
-	case "background", "bg":
+	case "background":
 		if err := applyBackgroundOption(po, args); err != nil {
 			return err
 		}
-	case "blur", "bl":
+	case "blur":
 		if err := applyBlurOption(po, args); err != nil {
 			return err
 		}
-	case "sharpen", "sh":
+	case "sharpen":
 		if err := applySharpenOption(po, args); err != nil {
 			return err
 		}
-	case "watermark", "wm":
+	case "watermark":
 		if err := applyWatermarkOption(po, args); err != nil {
 			return err
 		}
-	case "preset", "pr":
+	case "watermark_url":
+		if err := applyWatermarkURLOption(po, args); err != nil {
+			return err
+		}
+	case "preset":
 		if err := applyPresetOption(po, args); err != nil {
 			return err
 		}
-	case "cachebuster", "cb":
+	case "cachebuster":
 		if err := applyCacheBusterOption(po, args); err != nil {
 			return err
 		}
+	case "base_url":
+		if err := applyBaseURLOption(po, args); err != nil {
+			return err
+		}
+	case "timeout":
+		if err := applyTimeoutOption(po, args); err != nil {
+			return err
+		}
 	default:
 		return fmt.Errorf("Unknown processing option: %s", name)
 	}
@@ -683,6 +824,37 @@ func applyProcessingOption(po *processingOptions, name string, args []string) er
 	return nil
 }
 
+func checkProcessingOptionAllowed(name string) error {
+	fullName, ok := processingOptionsNames[name]
+	if !ok {
+		// Unknown options will be reported while applying
+		return nil
+	}
+
+	if len(conf.AllowedProcessingOptions) > 0 && !containsString(conf.AllowedProcessingOptions, fullName) {
+		return fmt.Errorf("Processing option is not allowed: %s", name)
+	}
+
+	if containsString(conf.ForbiddenProcessingOptions, fullName) {
+		return fmt.Errorf("Processing option is forbidden: %s", name)
+	}
+
+	return nil
+}
+
+// checkResultDimensions checks the final processing options, so presets can't exceed the limits too
+func checkResultDimensions(po *processingOptions) error {
+	if width := int(float64(po.Width) * po.Dpr); conf.MaxResultWidth > 0 && width > conf.MaxResultWidth {
+		return fmt.Errorf("Resulting width is too big: %d", width)
+	}
+
+	if height := int(float64(po.Height) * po.Dpr); conf.MaxResultHeight > 0 && height > conf.MaxResultHeight {
+		return fmt.Errorf("Resulting height is too big: %d", height)
+	}
+
+	return nil
+}
+
 func applyProcessingOptions(po *processingOptions, options urlOptions) error {
 	for name, args := range options {
 		if err := applyProcessingOption(po, name, args); err != nil {
@@ -728,7 +900,7 @@ func defaultProcessingOptions(headers *processingHeaders) (*processingOptions, e
 		Height:      0,
 		Gravity:     gravityOptions{Type: gravityCenter},
 		Enlarge:     false,
-		Quality:     conf.Quality,
+		Quality:     0,
 		Format:      imageTypeUnknown,
 		Background:  color{255, 255, 255},
 		Blur:        0,
@@ -771,11 +943,22 @@ func parsePathAdvanced(parts []string, headers *processingHeaders) (string, *pro
 
 	options, urlParts := parseURLOptions(parts)
 
+	for name := range options {
+		if err := checkProcessingOptionAllowed(name); err != nil {
+			return "", po, err
+		}
+	}
+
 	if err := applyProcessingOptions(po, options); err != nil {
 		return "", po, err
 	}
 
-	url, extension, err := decodeURL(urlParts)
+	baseURL := conf.BaseURL
+	if len(po.BaseURL) > 0 {
+		baseURL = conf.BaseURLs[po.BaseURL]
+	}
+
+	url, extension, err := decodeURL(urlParts, baseURL)
 	if err != nil {
 		return "", po, err
 	}
@@ -801,6 +984,12 @@ func parsePathBasic(parts []string, headers *processingHeaders) (string, *proces
 		return "", po, err
 	}
 
+	for _, name := range basicProcessingOptions {
+		if err = checkProcessingOptionAllowed(name); err != nil {
+			return "", po, err
+		}
+	}
+
 	po.Resize = resizeTypes[parts[0]]
 
 	if err = applyWidthOption(po, parts[1:2]); err != nil {
@@ -819,7 +1008,7 @@ func parsePathBasic(parts []string, headers *processingHeaders) (string, *proces
 		return "", po, err
 	}
 
-	url, extension, err := decodeURL(parts[5:])
+	url, extension, err := decodeURL(parts[5:], conf.BaseURL)
 	if err != nil {
 		return "", po, err
 	}
@@ -843,6 +1032,10 @@ func parsePath(ctx context.Context, r *http.Request) (context.Context, error) {
 
 	if !conf.AllowInsecure {
 		if err := validatePath(parts[0], strings.TrimPrefix(path, fmt.Sprintf("/%s", parts[0]))); err != nil {
+			if auditLogEnabled {
+				logAuditEvent(ctx, r, auditEventSignatureFailure, err.Error())
+			}
+
 			return ctx, newError(403, err.Error(), msgForbidden)
 		}
 	}
@@ -868,6 +1061,16 @@ func parsePath(ctx context.Context, r *http.Request) (context.Context, error) {
 		return ctx, newError(404, err.Error(), msgInvalidURL)
 	}
 
+	if err = checkResultDimensions(po); err != nil {
+		return ctx, newError(404, err.Error(), msgInvalidURL)
+	}
+
+	// Default quality depends on the source host, so we can resolve it only
+	// when the source URL is known
+	if po.Quality == 0 {
+		po.Quality = sourceHostConfigFor(imageURL).Quality
+	}
+
 	ctx = context.WithValue(ctx, imageURLCtxKey, imageURL)
 	ctx = context.WithValue(ctx, processingOptionsCtxKey, po)
 
@@ -40,6 +40,30 @@ func (s *ProcessingOptionsTestSuite) TestParseBase64URLWithoutExtension() {
 	assert.Equal(s.T(), imageTypeUnknown, getProcessingOptions(ctx).Format)
 }
 
+func (s *ProcessingOptionsTestSuite) TestParseBase64DataURLWithBase() {
+	conf.BaseURL = "http://images.dev/"
+	conf.AllowDataURLs = true
+
+	imageURL := "data:image/png;base64,iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNk+M9QDwADhgGAWjR9awAAAABJRU5ErkJggg=="
+	req := s.getRequest(fmt.Sprintf("http://example.com/unsafe/size:100:100/%s.png", base64.RawURLEncoding.EncodeToString([]byte(imageURL))))
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), imageURL, getImageURL(ctx))
+}
+
+func (s *ProcessingOptionsTestSuite) TestParseBase64DataURLWithBaseNotAllowed() {
+	conf.BaseURL = "http://images.dev/"
+	conf.AllowDataURLs = false
+
+	imageURL := "data:image/png;base64,iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNk+M9QDwADhgGAWjR9awAAAABJRU5ErkJggg=="
+	req := s.getRequest(fmt.Sprintf("http://example.com/unsafe/size:100:100/%s.png", base64.RawURLEncoding.EncodeToString([]byte(imageURL))))
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), fmt.Sprintf("%s%s", conf.BaseURL, imageURL), getImageURL(ctx))
+}
+
 func (s *ProcessingOptionsTestSuite) TestParseBase64URLWithBase() {
 	conf.BaseURL = "http://images.dev/"
 
@@ -52,6 +76,19 @@ func (s *ProcessingOptionsTestSuite) TestParseBase64URLWithBase() {
 	assert.Equal(s.T(), imageTypePNG, getProcessingOptions(ctx).Format)
 }
 
+func (s *ProcessingOptionsTestSuite) TestParseBase64URLWithNamedBase() {
+	conf.BaseURL = "http://images.dev/"
+	conf.BaseURLs = map[string]string{"cdn": "http://cdn.images.dev/"}
+
+	imageURL := "lorem/ipsum.jpg?param=value"
+	req := s.getRequest(fmt.Sprintf("http://example.com/unsafe/base_url:cdn/%s.png", base64.RawURLEncoding.EncodeToString([]byte(imageURL))))
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), fmt.Sprintf("%s%s", conf.BaseURLs["cdn"], imageURL), getImageURL(ctx))
+	assert.Equal(s.T(), imageTypePNG, getProcessingOptions(ctx).Format)
+}
+
 func (s *ProcessingOptionsTestSuite) TestParseBase64URLInvalid() {
 	imageURL := "lorem/ipsum.jpg?param=value"
 	req := s.getRequest(fmt.Sprintf("http://example.com/unsafe/size:100:100/%s.png", base64.RawURLEncoding.EncodeToString([]byte(imageURL))))
@@ -115,6 +152,28 @@ func (s *ProcessingOptionsTestSuite) TestParsePlainURLEscapedWithBase() {
 	assert.Equal(s.T(), imageTypePNG, getProcessingOptions(ctx).Format)
 }
 
+func (s *ProcessingOptionsTestSuite) TestParsePlainURLWithNamedBase() {
+	conf.BaseURL = "http://images.dev/"
+	conf.BaseURLs = map[string]string{"cdn": "http://cdn.images.dev/"}
+
+	imageURL := "lorem/ipsum.jpg"
+	req := s.getRequest(fmt.Sprintf("http://example.com/unsafe/bu:cdn/plain/%s@png", imageURL))
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), fmt.Sprintf("%s%s", conf.BaseURLs["cdn"], imageURL), getImageURL(ctx))
+	assert.Equal(s.T(), imageTypePNG, getProcessingOptions(ctx).Format)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePlainURLWithUnknownNamedBase() {
+	conf.BaseURLs = map[string]string{"cdn": "http://cdn.images.dev/"}
+
+	req := s.getRequest("http://example.com/unsafe/bu:legacy/plain/lorem/ipsum.jpg@png")
+	_, err := parsePath(context.Background(), req)
+
+	require.Error(s.T(), err)
+}
+
 func (s *ProcessingOptionsTestSuite) TestParsePlainURLInvalid() {
 	imageURL := "lorem/ipsum.jpg?param=value"
 	req := s.getRequest(fmt.Sprintf("http://example.com/unsafe/size:100:100/plain/%s@png", imageURL))
@@ -245,6 +304,24 @@ func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedGravityFocuspoint() {
 	assert.Equal(s.T(), 0.75, po.Gravity.Y)
 }
 
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedGravityObject() {
+	req := s.getRequest("http://example.com/unsafe/gravity:obj:face:car/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), gravityObject, po.Gravity.Type)
+	assert.Equal(s.T(), []string{"face", "car"}, po.Gravity.Classes)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedGravityObjectWithoutClasses() {
+	req := s.getRequest("http://example.com/unsafe/gravity:obj/plain/http://images.dev/lorem/ipsum.jpg")
+	_, err := parsePath(context.Background(), req)
+
+	require.Error(s.T(), err)
+}
+
 func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedQuality() {
 	req := s.getRequest("http://example.com/unsafe/quality:55/plain/http://images.dev/lorem/ipsum.jpg")
 	ctx, err := parsePath(context.Background(), req)
@@ -255,6 +332,26 @@ func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedQuality() {
 	assert.Equal(s.T(), 55, po.Quality)
 }
 
+func (s *ProcessingOptionsTestSuite) TestParsePathQualitySourceHost() {
+	conf.Presets = make(presets)
+	conf.Quality = 80
+	conf.SourceHosts = sourceHosts{
+		"images.dev": &sourceHostConfig{Quality: 90},
+	}
+
+	req := s.getRequest("http://example.com/unsafe/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), 90, getProcessingOptions(ctx).Quality)
+
+	req = s.getRequest("http://example.com/unsafe/quality:55/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err = parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), 55, getProcessingOptions(ctx).Quality)
+}
+
 func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedBackground() {
 	req := s.getRequest("http://example.com/unsafe/background:128:129:130/plain/http://images.dev/lorem/ipsum.jpg")
 	ctx, err := parsePath(context.Background(), req)
@@ -333,6 +430,26 @@ func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedWatermark() {
 	assert.Equal(s.T(), 0.6, po.Watermark.Scale)
 }
 
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedWatermarkURL() {
+	wmURL := "http://images.dev/watermark.png"
+	req := s.getRequest(fmt.Sprintf("http://example.com/unsafe/watermark:1/watermark_url:%s/plain/http://images.dev/lorem/ipsum.jpg", base64.RawURLEncoding.EncodeToString([]byte(wmURL))))
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.True(s.T(), po.Watermark.Enabled)
+	assert.Equal(s.T(), wmURL, po.Watermark.URL)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedWatermarkURLInvalid() {
+	wmURL := "watermark.png"
+	req := s.getRequest(fmt.Sprintf("http://example.com/unsafe/watermark:1/watermark_url:%s/plain/http://images.dev/lorem/ipsum.jpg", base64.RawURLEncoding.EncodeToString([]byte(wmURL))))
+	_, err := parsePath(context.Background(), req)
+
+	require.Error(s.T(), err)
+}
+
 func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedPreset() {
 	conf.Presets["test1"] = urlOptions{
 		"resizing_type": []string{"fill"},
@@ -398,6 +515,37 @@ func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedCachebuster() {
 	assert.Equal(s.T(), "123", po.CacheBuster)
 }
 
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedTimeout() {
+	conf.MaxRequestTimeout = 60
+
+	req := s.getRequest("http://example.com/unsafe/timeout:30/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), 30, po.Timeout)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedTimeoutCapped() {
+	conf.MaxRequestTimeout = 60
+
+	req := s.getRequest("http://example.com/unsafe/timeout:120/plain/http://images.dev/lorem/ipsum.jpg")
+	ctx, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	po := getProcessingOptions(ctx)
+	assert.Equal(s.T(), 60, po.Timeout)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathAdvancedTimeoutInvalid() {
+	req := s.getRequest("http://example.com/unsafe/timeout:0/plain/http://images.dev/lorem/ipsum.jpg")
+	_, err := parsePath(context.Background(), req)
+
+	require.Error(s.T(), err)
+}
+
 func (s *ProcessingOptionsTestSuite) TestParsePathWebpDetection() {
 	conf.EnableWebpDetection = true
 
@@ -535,6 +683,80 @@ func (s *ProcessingOptionsTestSuite) TestParsePathDprHeaderDisabled() {
 	assert.Equal(s.T(), 1.0, po.Dpr)
 }
 
+func (s *ProcessingOptionsTestSuite) TestParsePathForbiddenOption() {
+	conf.ForbiddenProcessingOptions = []string{"blur"}
+
+	req := s.getRequest("http://example.com/unsafe/bl:2/plain/http://images.dev/lorem/ipsum.jpg")
+	_, err := parsePath(context.Background(), req)
+
+	require.Error(s.T(), err)
+	assert.Equal(s.T(), "Processing option is forbidden: bl", err.Error())
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathNotAllowedOption() {
+	conf.AllowedProcessingOptions = []string{"width", "quality"}
+
+	req := s.getRequest("http://example.com/unsafe/w:100/q:50/plain/http://images.dev/lorem/ipsum.jpg")
+	_, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	req = s.getRequest("http://example.com/unsafe/w:100/sharpen:1/plain/http://images.dev/lorem/ipsum.jpg")
+	_, err = parsePath(context.Background(), req)
+
+	require.Error(s.T(), err)
+	assert.Equal(s.T(), "Processing option is not allowed: sharpen", err.Error())
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathForbiddenOptionInPreset() {
+	conf.ForbiddenProcessingOptions = []string{"blur"}
+	conf.Presets["test1"] = urlOptions{
+		"blur": []string{"0.2"},
+	}
+
+	req := s.getRequest("http://example.com/unsafe/preset:test1/plain/http://images.dev/lorem/ipsum.jpg")
+	_, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathBasicForbiddenOption() {
+	conf.ForbiddenProcessingOptions = []string{"gravity"}
+
+	req := s.getRequest("http://example.com/unsafe/fill/100/200/noea/1/plain/http://images.dev/lorem/ipsum.jpg@png")
+	_, err := parsePath(context.Background(), req)
+
+	require.Error(s.T(), err)
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathMaxResultWidth() {
+	conf.MaxResultWidth = 500
+
+	req := s.getRequest("http://example.com/unsafe/w:500/plain/http://images.dev/lorem/ipsum.jpg")
+	_, err := parsePath(context.Background(), req)
+
+	require.Nil(s.T(), err)
+
+	req = s.getRequest("http://example.com/unsafe/w:300/dpr:2/plain/http://images.dev/lorem/ipsum.jpg")
+	_, err = parsePath(context.Background(), req)
+
+	require.Error(s.T(), err)
+	assert.Equal(s.T(), "Resulting width is too big: 600", err.Error())
+}
+
+func (s *ProcessingOptionsTestSuite) TestParsePathMaxResultWidthInPreset() {
+	conf.MaxResultWidth = 500
+	conf.Presets["test1"] = urlOptions{
+		"width": []string{"2000"},
+	}
+
+	req := s.getRequest("http://example.com/unsafe/preset:test1/plain/http://images.dev/lorem/ipsum.jpg")
+	_, err := parsePath(context.Background(), req)
+
+	require.Error(s.T(), err)
+	assert.Equal(s.T(), "Resulting width is too big: 2000", err.Error())
+}
+
 func (s *ProcessingOptionsTestSuite) TestParsePathSigned() {
 	conf.Keys = []securityKey{securityKey("test-key")}
 	conf.Salts = []securityKey{securityKey("test-salt")}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// How often expired results are removed from the cache directory
+const resultCacheSweepInterval = 10 * time.Minute
+
+type cachedResult struct {
+	path    string
+	imgtype imageType
+	expires time.Time
+}
+
+var (
+	resultCacheEnabled = false
+	sendfileEnabled    = false
+
+	cachedResultExpiresCtxKey = ctxKey("cachedResultExpires")
+
+	cachedResultExts = map[imageType]string{
+		imageTypeJPEG: "jpg",
+		imageTypePNG:  "png",
+		imageTypeWEBP: "webp",
+		imageTypeGIF:  "gif",
+		imageTypeICO:  "ico",
+	}
+)
+
+func initResultCache() {
+	if len(conf.ResultCachePath) == 0 {
+		return
+	}
+
+	if err := os.MkdirAll(conf.ResultCachePath, 0755); err != nil {
+		log.Fatalf("Can't create result cache directory: %s", err)
+	}
+
+	resultCacheEnabled = true
+	sendfileEnabled = len(conf.SendfileHeader) > 0
+
+	go func() {
+		for range time.Tick(resultCacheSweepInterval) {
+			sweepResultCache()
+		}
+	}()
+}
+
+// resultCacheMaxTTL returns the maximum TTL of the global config and source hosts overrides.
+// Results older than that are expired whatever their source host is
+func resultCacheMaxTTL() time.Duration {
+	ttl := conf.TTL
+
+	for _, hc := range conf.SourceHosts {
+		if hc.TTL > ttl {
+			ttl = hc.TTL
+		}
+	}
+
+	return time.Duration(ttl) * time.Second
+}
+
+// sweepResultCache removes expired results from the cache directory. Results that are found
+// expired during lookup are removed right away, this cleans up the ones that are not requested anymore.
+// Temporary files left after crashes are removed as well
+func sweepResultCache() {
+	maxAge := resultCacheMaxTTL()
+
+	filepath.Walk(conf.ResultCachePath, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+
+		if time.Since(info.ModTime()) > maxAge {
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				warning("Can't remove expired result from cache: %s", err)
+			}
+		}
+
+		return nil
+	})
+}
+
+func calcResultCacheKey(ctx context.Context) string {
+	c := eTagCalcPool.Get().(*eTagCalc)
+	defer eTagCalcPool.Put(c)
+
+	c.hash.Reset()
+	c.hash.Write([]byte(version))
+	c.hash.Write([]byte(getImageURL(ctx)))
+	// Config affects the result the same way processing options do, e.g. watermark image
+	// or opacity, so results cached with the other config shouldn't be used
+	c.enc.Encode(conf)
+	c.enc.Encode(getProcessingOptions(ctx))
+
+	return hex.EncodeToString(c.hash.Sum(nil))
+}
+
+// cachedResultPath returns the path of the cached result relative to the cache directory.
+// Results are spread across subdirectories to keep directories small
+func cachedResultPath(key string, imgtype imageType) string {
+	return filepath.Join(key[:2], key+"."+cachedResultExts[imgtype])
+}
+
+// findCachedResult looks for the not expired cached result and removes the expired ones.
+// The path of the result is relative to the cache directory. When resulting format is unknown yet, the result of any format is accepted
+func findCachedResult(ctx context.Context, key string) (*cachedResult, bool) {
+	po := getProcessingOptions(ctx)
+
+	var paths []string
+
+	if po.Format == imageTypeUnknown {
+		paths, _ = filepath.Glob(filepath.Join(conf.ResultCachePath, key[:2], key+".*"))
+	} else {
+		paths = []string{
+			filepath.Join(conf.ResultCachePath, cachedResultPath(key, po.Format)),
+		}
+	}
+
+	ttl := time.Duration(sourceHostConfigFor(getImageURL(ctx)).TTL) * time.Second
+
+	for _, p := range paths {
+		stat, err := os.Stat(p)
+		if err != nil {
+			continue
+		}
+
+		expires := stat.ModTime().Add(ttl)
+		if time.Now().After(expires) {
+			os.Remove(p)
+			continue
+		}
+
+		imgtype, ok := imageTypes[strings.TrimPrefix(filepath.Ext(p), ".")]
+		if !ok {
+			continue
+		}
+
+		return &cachedResult{
+			path:    cachedResultPath(key, imgtype),
+			imgtype: imgtype,
+			expires: expires,
+		}, true
+	}
+
+	return nil, false
+}
+
+// storeCachedResult writes the result to the cache directory and returns its relative path.
+// The result is written to the temporary file first so no one can read a partially written file
+func storeCachedResult(key string, imgtype imageType, data []byte) (string, error) {
+	relPath := cachedResultPath(key, imgtype)
+	fullPath := filepath.Join(conf.ResultCachePath, relPath)
+
+	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+		return "", err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(fullPath), ".tmp-")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		// Files should be readable by the web server that serves them
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), fullPath)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return relPath, nil
+}
+
+func readCachedResult(relPath string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(conf.ResultCachePath, relPath))
+}
+
+func sendfileHeaderValue(relPath string) string {
+	return path.Join(conf.SendfilePrefix, filepath.ToSlash(relPath))
+}
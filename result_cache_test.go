@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type ResultCacheTestSuite struct {
+	MainTestSuite
+
+	dir string
+}
+
+func (s *ResultCacheTestSuite) SetupTest() {
+	s.MainTestSuite.SetupTest()
+
+	dir, err := ioutil.TempDir("", "imgproxy-result-cache")
+	require.Nil(s.T(), err)
+
+	s.dir = dir
+	conf.ResultCachePath = dir
+	conf.Presets = make(presets)
+}
+
+func (s *ResultCacheTestSuite) TearDownTest() {
+	os.RemoveAll(s.dir)
+
+	s.MainTestSuite.TearDownTest()
+}
+
+func (s *ResultCacheTestSuite) parsePath(path string) context.Context {
+	req, _ := http.NewRequest("GET", path, nil)
+
+	ctx, err := parsePath(context.Background(), req)
+	require.Nil(s.T(), err)
+
+	return ctx
+}
+
+func (s *ResultCacheTestSuite) TestStoreAndFind() {
+	ctx := s.parsePath("http://example.com/unsafe/w:100/plain/http://images.dev/lorem/ipsum.jpg@png")
+	key := calcResultCacheKey(ctx)
+
+	relPath, err := storeCachedResult(key, imageTypePNG, []byte("test"))
+	require.Nil(s.T(), err)
+
+	cached, ok := findCachedResult(ctx, key)
+
+	require.True(s.T(), ok)
+	assert.Equal(s.T(), relPath, cached.path)
+	assert.Equal(s.T(), imageTypePNG, cached.imgtype)
+
+	data, err := readCachedResult(cached.path)
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), []byte("test"), data)
+}
+
+func (s *ResultCacheTestSuite) TestFindUnknownFormat() {
+	ctx := s.parsePath("http://example.com/unsafe/w:100/plain/http://images.dev/lorem/ipsum.jpg")
+	key := calcResultCacheKey(ctx)
+
+	_, ok := findCachedResult(ctx, key)
+	require.False(s.T(), ok)
+
+	_, err := storeCachedResult(key, imageTypeJPEG, []byte("test"))
+	require.Nil(s.T(), err)
+
+	cached, ok := findCachedResult(ctx, key)
+
+	require.True(s.T(), ok)
+	assert.Equal(s.T(), imageTypeJPEG, cached.imgtype)
+}
+
+func (s *ResultCacheTestSuite) TestDifferentOptions() {
+	ctx1 := s.parsePath("http://example.com/unsafe/w:100/plain/http://images.dev/lorem/ipsum.jpg@png")
+	ctx2 := s.parsePath("http://example.com/unsafe/w:200/plain/http://images.dev/lorem/ipsum.jpg@png")
+
+	assert.NotEqual(s.T(), calcResultCacheKey(ctx1), calcResultCacheKey(ctx2))
+}
+
+func (s *ResultCacheTestSuite) TestDifferentTimeout() {
+	conf.MaxRequestTimeout = 60
+
+	ctx1 := s.parsePath("http://example.com/unsafe/w:100/plain/http://images.dev/lorem/ipsum.jpg@png")
+	ctx2 := s.parsePath("http://example.com/unsafe/w:100/timeout:30/plain/http://images.dev/lorem/ipsum.jpg@png")
+
+	assert.Equal(s.T(), calcResultCacheKey(ctx1), calcResultCacheKey(ctx2))
+}
+
+func (s *ResultCacheTestSuite) TestExpired() {
+	conf.TTL = 60
+
+	ctx := s.parsePath("http://example.com/unsafe/w:100/plain/http://images.dev/lorem/ipsum.jpg@png")
+	key := calcResultCacheKey(ctx)
+
+	relPath, err := storeCachedResult(key, imageTypePNG, []byte("test"))
+	require.Nil(s.T(), err)
+
+	past := time.Now().Add(-2 * time.Minute)
+	require.Nil(s.T(), os.Chtimes(filepath.Join(s.dir, relPath), past, past))
+
+	_, ok := findCachedResult(ctx, key)
+	assert.False(s.T(), ok)
+
+	_, err = os.Stat(filepath.Join(s.dir, relPath))
+	assert.True(s.T(), os.IsNotExist(err))
+}
+
+func (s *ResultCacheTestSuite) TestSweep() {
+	conf.TTL = 60
+	conf.SourceHosts = sourceHosts{"images.dev": {TTL: 600}}
+
+	fresh, err := storeCachedResult("aa01", imageTypePNG, []byte("test"))
+	require.Nil(s.T(), err)
+
+	// Expired for the global TTL but can belong to the source host with the longer TTL
+	longTTL, err := storeCachedResult("aa02", imageTypePNG, []byte("test"))
+	require.Nil(s.T(), err)
+
+	expired, err := storeCachedResult("aa03", imageTypePNG, []byte("test"))
+	require.Nil(s.T(), err)
+
+	past := time.Now().Add(-5 * time.Minute)
+	require.Nil(s.T(), os.Chtimes(filepath.Join(s.dir, longTTL), past, past))
+
+	past = time.Now().Add(-20 * time.Minute)
+	require.Nil(s.T(), os.Chtimes(filepath.Join(s.dir, expired), past, past))
+
+	sweepResultCache()
+
+	_, err = os.Stat(filepath.Join(s.dir, fresh))
+	assert.Nil(s.T(), err)
+
+	_, err = os.Stat(filepath.Join(s.dir, longTTL))
+	assert.Nil(s.T(), err)
+
+	_, err = os.Stat(filepath.Join(s.dir, expired))
+	assert.True(s.T(), os.IsNotExist(err))
+}
+
+func (s *ResultCacheTestSuite) TestCachedResultDoesntWaitForSlot() {
+	conf.Concurrency = 1
+	resultCacheEnabled = true
+	defer func() { resultCacheEnabled = false }()
+
+	req := httptest.NewRequest("GET", "http://example.com/unsafe/w:100/plain/http://images.dev/lorem/ipsum.jpg@png", nil)
+
+	_, err := storeCachedResult(calcResultCacheKey(s.parsePath(req.URL.String())), imageTypePNG, []byte("test"))
+	require.Nil(s.T(), err)
+
+	h := newHTTPHandler()
+
+	// All the processing slots are busy
+	h.lock()
+	defer h.unlock()
+
+	rw := httptest.NewRecorder()
+	done := make(chan struct{})
+
+	go func() {
+		h.ServeHTTP(rw, req)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		s.T().Fatal("Cached result should be sent without waiting for a processing slot")
+	}
+
+	assert.Equal(s.T(), 200, rw.Code)
+	assert.Equal(s.T(), []byte("test"), rw.Body.Bytes())
+}
+
+func (s *ResultCacheTestSuite) TestDifferentConfig() {
+	ctx := s.parsePath("http://example.com/unsafe/w:100/plain/http://images.dev/lorem/ipsum.jpg@png")
+	key1 := calcResultCacheKey(ctx)
+
+	conf.WatermarkOpacity = 0.5
+	key2 := calcResultCacheKey(ctx)
+
+	assert.NotEqual(s.T(), key1, key2)
+}
+
+func (s *ResultCacheTestSuite) TestRemainingTTLHeaders() {
+	conf.TTL = 600
+
+	ctx := s.parsePath("http://example.com/unsafe/w:100/plain/http://images.dev/lorem/ipsum.jpg@png")
+	key := calcResultCacheKey(ctx)
+
+	relPath, err := storeCachedResult(key, imageTypePNG, []byte("test"))
+	require.Nil(s.T(), err)
+
+	stored := time.Now().Add(-200 * time.Second)
+	require.Nil(s.T(), os.Chtimes(filepath.Join(s.dir, relPath), stored, stored))
+
+	cached, ok := findCachedResult(ctx, key)
+	require.True(s.T(), ok)
+
+	rw := httptest.NewRecorder()
+	writeImageHeaders(context.WithValue(ctx, cachedResultExpiresCtxKey, cached.expires), rw)
+
+	var maxAge int
+	fmt.Sscanf(rw.Header().Get("Cache-Control"), "max-age=%d", &maxAge)
+
+	assert.InDelta(s.T(), 400, maxAge, 2)
+	assert.Equal(s.T(), stored.Add(600*time.Second).UTC().Format(http.TimeFormat), rw.Header().Get("Expires"))
+}
+
+func (s *ResultCacheTestSuite) TestSendfileHeaderValue() {
+	conf.SendfilePrefix = "/imgproxy-cache/"
+
+	assert.Equal(s.T(), "/imgproxy-cache/ab/abcd.png", sendfileHeaderValue(filepath.Join("ab", "abcd.png")))
+}
+
+func TestResultCache(t *testing.T) {
+	suite.Run(t, new(ResultCacheTestSuite))
+}
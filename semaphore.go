@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// semaphore limits the number of simultaneous holders. Unlike a buffered channel,
+// its size can be changed at runtime. When the size is reduced, current holders
+// keep their slots and new ones wait until the number of holders fits the new size.
+// The number of waiters can be limited with queueSize, 0 means no limit
+type semaphore struct {
+	mutex sync.Mutex
+	cond  *sync.Cond
+
+	size      int
+	queueSize int
+	used      int
+	waiting   int
+	closed    bool
+}
+
+func newSemaphore(size, queueSize int) *semaphore {
+	s := &semaphore{size: size, queueSize: queueSize}
+	s.cond = sync.NewCond(&s.mutex)
+	return s
+}
+
+// acquire waits for a free slot. It returns false without waiting
+// if there is no free slot and the queue is full, or when the semaphore is closed
+func (s *semaphore) acquire() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed || s.used >= s.size && s.queueSize > 0 && s.waiting >= s.queueSize {
+		return false
+	}
+
+	s.waiting++
+
+	for s.used >= s.size && !s.closed {
+		s.cond.Wait()
+	}
+
+	s.waiting--
+
+	if s.closed {
+		return false
+	}
+
+	s.used++
+
+	return true
+}
+
+func (s *semaphore) release() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.used--
+	s.cond.Signal()
+}
+
+// close wakes up all the waiters, so they don't wait for a slot forever
+// when no one is going to release it
+func (s *semaphore) close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.closed = true
+	s.cond.Broadcast()
+}
+
+func (s *semaphore) resize(size int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.size = size
+	s.cond.Broadcast()
+}
+
+// resizeQueue changes the queue size. Requests that are already waiting
+// keep waiting even if there are more of them than the new size
+func (s *semaphore) resizeQueue(queueSize int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.queueSize = queueSize
+}
+
+func (s *semaphore) queueLimit() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.queueSize
+}
+
+func (s *semaphore) stats() (size, used, waiting int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.size, s.used, s.waiting
+}
+
+// limitListener limits the number of simultaneously accepted connections
+// like netutil.LimitListener does, but the limit can be changed at runtime
+type limitListener struct {
+	net.Listener
+	sem *semaphore
+}
+
+type limitListenerConn struct {
+	net.Conn
+	releaseOnce sync.Once
+	release     func()
+}
+
+func newLimitListener(l net.Listener, n int) *limitListener {
+	return &limitListener{l, newSemaphore(n, 0)}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	// The semaphore is closed only when the listener is closed,
+	// so the underlying listener returns the proper error
+	if !l.sem.acquire() {
+		return l.Listener.Accept()
+	}
+
+	c, err := l.Listener.Accept()
+	if err != nil {
+		l.sem.release()
+		return nil, err
+	}
+
+	return &limitListenerConn{Conn: c, release: l.sem.release}, nil
+}
+
+// Close closes the listener and stops Accept waiting for free slot
+func (l *limitListener) Close() error {
+	err := l.Listener.Close()
+	l.sem.close()
+	return err
+}
+
+func (c *limitListenerConn) Close() error {
+	err := c.Conn.Close()
+	c.releaseOnce.Do(c.release)
+	return err
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type SemaphoreTestSuite struct{ MainTestSuite }
+
+func (s *SemaphoreTestSuite) waitAcquired(sem *semaphore) chan struct{} {
+	acquired := make(chan struct{})
+
+	go func() {
+		sem.acquire()
+		close(acquired)
+	}()
+
+	return acquired
+}
+
+func (s *SemaphoreTestSuite) TestAcquireRelease() {
+	sem := newSemaphore(1, 0)
+	sem.acquire()
+
+	acquired := s.waitAcquired(sem)
+
+	select {
+	case <-acquired:
+		s.T().Fatal("Semaphore should be full")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	_, _, waiting := sem.stats()
+	assert.Equal(s.T(), 1, waiting)
+
+	sem.release()
+
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		s.T().Fatal("Semaphore should be released")
+	}
+}
+
+func (s *SemaphoreTestSuite) TestResizeUp() {
+	sem := newSemaphore(1, 0)
+	sem.acquire()
+
+	acquired := s.waitAcquired(sem)
+	time.Sleep(20 * time.Millisecond)
+
+	sem.resize(2)
+
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		s.T().Fatal("Semaphore should have free slot after resize")
+	}
+
+	size, used, waiting := sem.stats()
+	assert.Equal(s.T(), 2, size)
+	assert.Equal(s.T(), 2, used)
+	assert.Equal(s.T(), 0, waiting)
+}
+
+func (s *SemaphoreTestSuite) TestResizeDown() {
+	sem := newSemaphore(2, 0)
+	sem.acquire()
+	sem.acquire()
+
+	sem.resize(1)
+	sem.release()
+
+	acquired := s.waitAcquired(sem)
+
+	select {
+	case <-acquired:
+		s.T().Fatal("Semaphore should be full after resize")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	sem.release()
+
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		s.T().Fatal("Semaphore should be released")
+	}
+}
+
+func (s *SemaphoreTestSuite) TestQueueIsFull() {
+	sem := newSemaphore(1, 1)
+	sem.acquire()
+
+	acquired := s.waitAcquired(sem)
+	time.Sleep(20 * time.Millisecond)
+
+	assert.False(s.T(), sem.acquire())
+
+	_, _, waiting := sem.stats()
+	assert.Equal(s.T(), 1, waiting)
+
+	sem.release()
+
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		s.T().Fatal("Queued request should acquire the semaphore")
+	}
+}
+
+func (s *SemaphoreTestSuite) TestResizeQueue() {
+	sem := newSemaphore(1, 0)
+	sem.acquire()
+
+	s.waitAcquired(sem)
+	time.Sleep(20 * time.Millisecond)
+
+	sem.resizeQueue(1)
+
+	assert.Equal(s.T(), 1, sem.queueLimit())
+	assert.False(s.T(), sem.acquire())
+
+	sem.release()
+	sem.release()
+}
+
+func (s *SemaphoreTestSuite) TestClose() {
+	sem := newSemaphore(1, 0)
+	sem.acquire()
+
+	acquired := make(chan bool)
+
+	go func() {
+		acquired <- sem.acquire()
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+
+	sem.close()
+
+	select {
+	case ok := <-acquired:
+		assert.False(s.T(), ok)
+	case <-time.After(time.Second):
+		s.T().Fatal("Waiter should leave when semaphore is closed")
+	}
+
+	assert.False(s.T(), sem.acquire())
+}
+
+func (s *SemaphoreTestSuite) TestLimitListenerClose() {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(s.T(), err)
+
+	listener := newLimitListener(l, 1)
+	listener.sem.acquire()
+
+	accepted := make(chan error)
+
+	go func() {
+		_, err := listener.Accept()
+		accepted <- err
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+
+	listener.Close()
+
+	select {
+	case err := <-accepted:
+		assert.Error(s.T(), err)
+	case <-time.After(time.Second):
+		s.T().Fatal("Accept should return when listener is closed")
+	}
+}
+
+func (s *SemaphoreTestSuite) TestHandlerQueueIsFull() {
+	conf.Concurrency = 1
+	conf.MaxQueue = 1
+
+	h := newHTTPHandler()
+	h.lock()
+
+	locked := make(chan struct{})
+
+	go func() {
+		h.lock()
+		close(locked)
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+
+	assert.PanicsWithValue(s.T(), errQueueIsFull, h.lock)
+
+	h.unlock()
+	<-locked
+	h.unlock()
+}
+
+func TestSemaphore(t *testing.T) {
+	suite.Run(t, new(SemaphoreTestSuite))
+}
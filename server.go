@@ -16,7 +16,6 @@ import (
 	"time"
 
 	nanoid "github.com/matoous/go-nanoid"
-	"golang.org/x/net/netutil"
 )
 
 const (
@@ -47,6 +46,9 @@ var (
 
 	errInvalidMethod = newError(422, "Invalid request method", "Method doesn't allowed")
 	errInvalidSecret = newError(403, "Invalid secret", "Forbidden")
+	errQueueIsFull   = newError(503, "Too many requests in the queue", "Service unavailable")
+
+	adminServer *http.Server
 )
 
 var responseBufPool = sync.Pool{
@@ -56,11 +58,11 @@ var responseBufPool = sync.Pool{
 }
 
 type httpHandler struct {
-	sem chan struct{}
+	sem *semaphore
 }
 
 func newHTTPHandler() *httpHandler {
-	return &httpHandler{make(chan struct{}, conf.Concurrency)}
+	return &httpHandler{newSemaphore(conf.Concurrency, conf.MaxQueue)}
 }
 
 func startServer() *http.Server {
@@ -68,19 +70,27 @@ func startServer() *http.Server {
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	handler := newHTTPHandler()
+	listener := newLimitListener(l, conf.MaxClients)
+
 	s := &http.Server{
-		Handler:        newHTTPHandler(),
+		Handler:        handler,
 		ReadTimeout:    time.Duration(conf.ReadTimeout) * time.Second,
 		MaxHeaderBytes: 1 << 20,
 	}
 
 	go func() {
 		log.Printf("Starting server at %s\n", conf.Bind)
-		if err := s.Serve(netutil.LimitListener(l, conf.MaxClients)); err != nil && err != http.ErrServerClosed {
+		if err := s.Serve(listener); err != nil && err != http.ErrServerClosed {
 			log.Fatalln(err)
 		}
 	}()
 
+	if len(conf.AdminBind) > 0 {
+		adminServer = startAdminServer(handler, listener)
+	}
+
 	return s
 }
 
@@ -90,18 +100,32 @@ func shutdownServer(s *http.Server) {
 	ctx, close := context.WithTimeout(context.Background(), 5*time.Second)
 	defer close()
 
+	if adminServer != nil {
+		adminServer.Shutdown(ctx)
+	}
+
 	s.Shutdown(ctx)
 }
 
 func logResponse(status int, msg string) {
-	var color int
+	var (
+		color int
+		level int32
+	)
 
 	if status >= 500 {
 		color = 31
+		level = logLevelError
 	} else if status >= 400 {
 		color = 33
+		level = logLevelWarning
 	} else {
 		color = 32
+		level = logLevelInfo
+	}
+
+	if !logLevelEnabled(level) {
+		return
 	}
 
 	log.Printf("|\033[7;%dm %d \033[0m| %s\n", color, status, msg)
@@ -128,13 +152,27 @@ func contentDisposition(imageURL string, imgtype imageType) string {
 	return fmt.Sprintf(contentDispositionsFmt[imgtype], strings.TrimSuffix(filename, filepath.Ext(filename)))
 }
 
-func respondWithImage(ctx context.Context, reqID string, r *http.Request, rw http.ResponseWriter, data []byte) {
+func writeImageHeaders(ctx context.Context, rw http.ResponseWriter) {
 	po := getProcessingOptions(ctx)
+	ttl := sourceHostConfigFor(getImageURL(ctx)).TTL
+	expires := time.Now().Add(time.Second * time.Duration(ttl))
+
+	// Cached results should expire downstream at the same time they expire in the cache
+	if cachedExpires, ok := ctx.Value(cachedResultExpiresCtxKey).(time.Time); ok {
+		expires = cachedExpires
+		ttl = maxInt(0, int(time.Until(expires).Seconds()))
+	}
 
-	rw.Header().Set("Expires", time.Now().Add(time.Second*time.Duration(conf.TTL)).Format(http.TimeFormat))
-	rw.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d, public", conf.TTL))
+	rw.Header().Set("Expires", expires.UTC().Format(http.TimeFormat))
+	rw.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d, public", ttl))
 	rw.Header().Set("Content-Type", mimes[po.Format])
 	rw.Header().Set("Content-Disposition", contentDisposition(getImageURL(ctx), po.Format))
+}
+
+func respondWithImage(ctx context.Context, reqID string, r *http.Request, rw http.ResponseWriter, data []byte) {
+	po := getProcessingOptions(ctx)
+
+	writeImageHeaders(ctx, rw)
 
 	if conf.GZipCompression > 0 && strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
 		buf := responseBufPool.Get().(*bytes.Buffer)
@@ -155,7 +193,34 @@ func respondWithImage(ctx context.Context, reqID string, r *http.Request, rw htt
 		rw.Write(data)
 	}
 
-	logResponse(200, fmt.Sprintf("[%s] Processed in %s: %s; %+v", reqID, getTimerSince(ctx), getImageURL(ctx), po))
+	logResponse(200, fmt.Sprintf("[%s] Processed in %s: %s; %+v", reqID, getTimerSince(ctx), redactDataURL(getImageURL(ctx)), redactProcessingOptions(po)))
+}
+
+func respondWithSendfile(ctx context.Context, reqID string, rw http.ResponseWriter, relPath string) {
+	writeImageHeaders(ctx, rw)
+
+	rw.Header().Set(conf.SendfileHeader, sendfileHeaderValue(relPath))
+	rw.WriteHeader(200)
+
+	logResponse(200, fmt.Sprintf("[%s] Sent via %s in %s: %s; %+v", reqID, conf.SendfileHeader, getTimerSince(ctx), redactDataURL(getImageURL(ctx)), redactProcessingOptions(getProcessingOptions(ctx))))
+}
+
+func respondWithCachedResult(ctx context.Context, reqID string, r *http.Request, rw http.ResponseWriter, res *cachedResult) {
+	getProcessingOptions(ctx).Format = res.imgtype
+
+	ctx = context.WithValue(ctx, cachedResultExpiresCtxKey, res.expires)
+
+	if sendfileEnabled {
+		respondWithSendfile(ctx, reqID, rw, res.path)
+		return
+	}
+
+	data, err := readCachedResult(res.path)
+	if err != nil {
+		panic(newUnexpectedError(err, 1))
+	}
+
+	respondWithImage(ctx, reqID, r, rw, data)
 }
 
 func respondWithError(reqID string, rw http.ResponseWriter, err *imgproxyError) {
@@ -194,22 +259,40 @@ func checkSecret(r *http.Request) bool {
 	) == 1
 }
 
+func requestTimeout(ctx context.Context) time.Duration {
+	timeout := conf.WriteTimeout
+
+	if po := getProcessingOptions(ctx); po.Timeout > 0 {
+		timeout = po.Timeout
+	}
+
+	return time.Duration(timeout) * time.Second
+}
+
 func (h *httpHandler) lock() {
-	h.sem <- struct{}{}
+	if !h.sem.acquire() {
+		panic(errQueueIsFull)
+	}
 }
 
 func (h *httpHandler) unlock() {
-	<-h.sem
+	h.sem.release()
 }
 
 func (h *httpHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	reqID, _ := nanoid.Nanoid()
 
+	ctx := context.WithValue(context.Background(), requestIDCtxKey, reqID)
+
 	defer func() {
 		if rerr := recover(); rerr != nil {
 			if err, ok := rerr.(error); ok {
 				reportError(err, r)
 
+				if errorWebhookEnabled {
+					sendErrorToWebhook(ctx, err)
+				}
+
 				if ierr, ok := err.(*imgproxyError); ok {
 					respondWithError(reqID, rw, ierr)
 				} else {
@@ -218,10 +301,14 @@ func (h *httpHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 			} else {
 				panic(rerr)
 			}
+		} else if errorWebhookEnabled {
+			checkSlowRequest(ctx)
 		}
 	}()
 
-	log.Printf("[%s] %s: %s\n", reqID, r.Method, r.URL.RequestURI())
+	if logLevelEnabled(logLevelInfo) {
+		log.Printf("[%s] %s: %s\n", reqID, r.Method, redactRequestURI(r.URL.RequestURI()))
+	}
 
 	writeCORS(rw)
 
@@ -235,6 +322,10 @@ func (h *httpHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	}
 
 	if !checkSecret(r) {
+		if auditLogEnabled {
+			logAuditEvent(ctx, r, auditEventSecretMismatch, errInvalidSecret.Message)
+		}
+
 		panic(errInvalidSecret)
 	}
 
@@ -244,8 +335,6 @@ func (h *httpHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ctx := context.Background()
-
 	if newRelicEnabled {
 		var newRelicCancel context.CancelFunc
 		ctx, newRelicCancel = startNewRelicTransaction(ctx, rw, r)
@@ -257,17 +346,95 @@ func (h *httpHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 		defer startPrometheusDuration(prometheusRequestDuration)()
 	}
 
+	if otlpEnabled {
+		ctx = startOTLPRequest(ctx, r)
+		defer startOTLPDuration(ctx, otlpRequestDuration)()
+	}
+
+	ctx, err := parsePath(ctx, r)
+	if err != nil {
+		panic(err)
+	}
+
+	var resultKey string
+
+	if resultCacheEnabled || conf.CoalesceRequests {
+		resultKey = calcResultCacheKey(ctx)
+	}
+
+	// Sending the cached result is cheap, so it doesn't wait for a processing slot
+	if resultCacheEnabled {
+		if cached, ok := findCachedResult(ctx, resultKey); ok {
+			var cachedCancel context.CancelFunc
+			ctx, cachedCancel = startTimer(ctx, requestTimeout(ctx))
+			defer cachedCancel()
+
+			respondWithCachedResult(ctx, reqID, r, rw, cached)
+			return
+		}
+	}
+
 	h.lock()
 	defer h.unlock()
 
-	ctx, timeoutCancel := startTimer(ctx, time.Duration(conf.WriteTimeout)*time.Second)
+	ctx, timeoutCancel := startTimer(ctx, requestTimeout(ctx))
 	defer timeoutCancel()
 
-	ctx, err := parsePath(ctx, r)
+	var res *processingResult
+
+	if conf.CoalesceRequests {
+		// We don't know if other requests have the same ETag, so the image is always processed.
+		// The result is cached by the shared processing once, not by every request
+		res = coalesceProcessing(ctx, resultKey, func(sctx context.Context) *processingResult {
+			res := downloadAndProcessImage(sctx, "")
+
+			if resultCacheEnabled {
+				storeResult(resultKey, res)
+			}
+
+			return res
+		})
+
+		getProcessingOptions(ctx).Format = res.imgtype
+	} else {
+		res = downloadAndProcessImage(ctx, r.Header.Get("If-None-Match"))
+	}
+
+	if conf.ETagEnabled {
+		rw.Header().Set("ETag", res.eTag)
+
+		if res.eTag == r.Header.Get("If-None-Match") {
+			respondWithNotModified(reqID, rw)
+			return
+		}
+	}
+
+	if resultCacheEnabled && !conf.CoalesceRequests {
+		storeResult(resultKey, res)
+	}
+
+	if sendfileEnabled && len(res.cachePath) > 0 {
+		respondWithSendfile(ctx, reqID, rw, res.cachePath)
+		return
+	}
+
+	respondWithImage(ctx, reqID, r, rw, res.data)
+}
+
+// storeResult stores the result to the result cache and remembers its path in the result
+func storeResult(key string, res *processingResult) {
+	relPath, err := storeCachedResult(key, res.imgtype, res.data)
 	if err != nil {
-		panic(err)
+		warning("Can't store result to cache: %s", err)
+		return
 	}
 
+	res.cachePath = relPath
+}
+
+// downloadAndProcessImage downloads and processes the image. When ETag is enabled and matches
+// the provided one, processing is skipped since the client already has the result
+func downloadAndProcessImage(ctx context.Context, ifNoneMatch string) *processingResult {
 	ctx, downloadcancel, err := downloadImage(ctx)
 	defer downloadcancel()
 	if err != nil {
@@ -277,24 +444,27 @@ func (h *httpHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 		if prometheusEnabled {
 			incrementPrometheusErrorsTotal("download")
 		}
+		if otlpEnabled {
+			incrementOTLPErrorsTotal("download")
+		}
 		panic(err)
 	}
 
 	checkTimeout(ctx)
 
+	var res processingResult
+
 	if conf.ETagEnabled {
-		eTag := calcETag(ctx)
-		rw.Header().Set("ETag", eTag)
+		res.eTag = calcETag(ctx)
 
-		if eTag == r.Header.Get("If-None-Match") {
-			respondWithNotModified(reqID, rw)
-			return
+		if res.eTag == ifNoneMatch {
+			return &res
 		}
 	}
 
 	checkTimeout(ctx)
 
-	imageData, err := processImage(ctx)
+	res.data, err = processImage(ctx)
 	if err != nil {
 		if newRelicEnabled {
 			sendErrorToNewRelic(ctx, err)
@@ -302,10 +472,15 @@ func (h *httpHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 		if prometheusEnabled {
 			incrementPrometheusErrorsTotal("processing")
 		}
+		if otlpEnabled {
+			incrementOTLPErrorsTotal("processing")
+		}
 		panic(err)
 	}
 
 	checkTimeout(ctx)
 
-	respondWithImage(ctx, reqID, r, rw, imageData)
+	res.imgtype = getProcessingOptions(ctx).Format
+
+	return &res
 }
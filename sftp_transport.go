@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpServer keeps the connection to the SFTP server, so it's not established for every image
+type sftpServer struct {
+	addr     string
+	basePath string
+	config   *ssh.ClientConfig
+	timeout  time.Duration
+
+	mutex  sync.Mutex
+	conn   *ssh.Client
+	client *sftp.Client
+}
+
+// sftpBody stops watching the download deadline when the file is closed
+type sftpBody struct {
+	file *sftp.File
+	ctx  context.Context
+	stop func()
+}
+
+// sftpTransport implements RoundTripper for the 'sftp' protocol.
+// The host of the requested URL is the name of the server defined in config,
+// so credentials are never exposed in image URLs
+type sftpTransport struct {
+	servers map[string]*sftpServer
+}
+
+func newSFTPTransport() http.RoundTripper {
+	hostKeyCallback, err := knownhosts.New(conf.SFTPKnownHosts)
+	if err != nil {
+		log.Fatalf("Can't read SFTP known hosts: %s", err)
+	}
+
+	servers := make(map[string]*sftpServer)
+
+	for name, server := range conf.SFTPServers {
+		// Server URLs are checked during config initialization
+		u, _ := url.Parse(server)
+
+		var auth []ssh.AuthMethod
+
+		if keyPath := conf.SFTPKeys[name]; len(keyPath) > 0 {
+			signer, err := loadSFTPKey(keyPath)
+			if err != nil {
+				log.Fatalf("Can't load SFTP key for %s: %s", name, err)
+			}
+
+			auth = append(auth, ssh.PublicKeys(signer))
+		}
+
+		if password, ok := u.User.Password(); ok {
+			auth = append(auth, ssh.Password(password))
+		}
+
+		port := u.Port()
+		if len(port) == 0 {
+			port = "22"
+		}
+
+		timeout := time.Duration(conf.DownloadTimeout) * time.Second
+
+		servers[name] = &sftpServer{
+			addr:     net.JoinHostPort(u.Hostname(), port),
+			basePath: u.Path,
+			config: &ssh.ClientConfig{
+				User:            u.User.Username(),
+				Auth:            auth,
+				HostKeyCallback: hostKeyCallback,
+			},
+			timeout: timeout,
+		}
+	}
+
+	return sftpTransport{servers}
+}
+
+func loadSFTPKey(keyPath string) (ssh.Signer, error) {
+	key, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return ssh.ParsePrivateKey(key)
+}
+
+func (s *sftpServer) getClient() (*sftp.Client, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.client != nil {
+		return s.client, nil
+	}
+
+	netConn, err := net.DialTimeout("tcp", s.addr, s.timeout)
+	if err != nil {
+		return nil, fmt.Errorf("Can't connect to SFTP server: %s", err)
+	}
+
+	// ssh.ClientConfig.Timeout limits only the dial, so we limit the handshakes
+	// with the connection deadline to not wait for the stalled server forever
+	netConn.SetDeadline(time.Now().Add(s.timeout))
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(netConn, s.addr, s.config)
+	if err != nil {
+		netConn.Close()
+		return nil, fmt.Errorf("Can't connect to SFTP server: %s", err)
+	}
+
+	conn := ssh.NewClient(sshConn, chans, reqs)
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Can't start SFTP session: %s", err)
+	}
+
+	netConn.SetDeadline(time.Time{})
+
+	s.conn, s.client = conn, client
+
+	return client, nil
+}
+
+// reset closes the broken connection, so the next request establishes a new one
+func (s *sftpServer) reset(client *sftp.Client) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// The connection could be already reestablished by another request
+	if s.client != client {
+		return
+	}
+
+	s.client.Close()
+	s.conn.Close()
+
+	s.client, s.conn = nil, nil
+}
+
+// filePath returns the path of the file on the server. When the server URL has no path,
+// the file path is relative to the login directory
+func (s *sftpServer) filePath(urlPath string) string {
+	p := path.Clean("/" + urlPath)
+
+	if len(s.basePath) == 0 {
+		return strings.TrimPrefix(p, "/")
+	}
+
+	return strings.TrimSuffix(s.basePath, "/") + p
+}
+
+// watch closes the connection when ctx is done before the returned stop function is called,
+// so the stalled server doesn't block the download forever. Requests to the stalled server
+// are blocked anyway, so it's ok to break them all
+func (s *sftpServer) watch(ctx context.Context, client *sftp.Client) func() {
+	done := make(chan struct{})
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.reset(client)
+		case <-done:
+		}
+	}()
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// open opens the file and returns the function that should be called when the file is closed
+func (s *sftpServer) open(ctx context.Context, filePath string) (*sftp.File, func(), error) {
+	client, err := s.getClient()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stop := s.watch(ctx, client)
+
+	f, err := client.Open(filePath)
+
+	// Server responds with status errors, any other error means that the connection is broken,
+	// e.g. it was closed by the server after some idle time. We reconnect and try again
+	if _, ok := err.(*sftp.StatusError); err != nil && !ok && err != os.ErrNotExist && ctx.Err() == nil {
+		stop()
+		s.reset(client)
+
+		if client, err = s.getClient(); err != nil {
+			return nil, nil, err
+		}
+
+		stop = s.watch(ctx, client)
+
+		f, err = client.Open(filePath)
+	}
+
+	if err != nil {
+		stop()
+
+		if ctx.Err() != nil {
+			return nil, nil, fmt.Errorf("SFTP download timed out: %s", ctx.Err())
+		}
+
+		return nil, nil, err
+	}
+
+	return f, stop, nil
+}
+
+// Read reports the timeout, since when the connection is closed by the watcher
+// the file reads may end with io.EOF and the body would look complete
+func (b sftpBody) Read(p []byte) (int, error) {
+	n, err := b.file.Read(p)
+
+	if err != nil && b.ctx.Err() != nil {
+		return n, fmt.Errorf("SFTP download timed out: %s", b.ctx.Err())
+	}
+
+	return n, err
+}
+
+func (b sftpBody) Close() error {
+	b.stop()
+	return b.file.Close()
+}
+
+func (t sftpTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	server, ok := t.servers[req.URL.Host]
+	if !ok {
+		return nil, fmt.Errorf("Unknown SFTP server: %s", req.URL.Host)
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), server.timeout)
+
+	f, stop, err := server.open(ctx, server.filePath(req.URL.Path))
+	if err != nil {
+		cancel()
+
+		if err == os.ErrNotExist {
+			return &http.Response{
+				Status:     "404 Not Found",
+				StatusCode: 404,
+				Proto:      "HTTP/1.0",
+				ProtoMajor: 1,
+				ProtoMinor: 0,
+				Header:     make(http.Header),
+				Body:       ioutil.NopCloser(strings.NewReader("File not found")),
+				Close:      true,
+				Request:    req,
+			}, nil
+		}
+
+		return nil, err
+	}
+
+	size := int64(-1)
+	if stat, err := f.Stat(); err == nil {
+		size = stat.Size()
+	}
+
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    200,
+		Proto:         "HTTP/1.0",
+		ProtoMajor:    1,
+		ProtoMinor:    0,
+		Header:        make(http.Header),
+		ContentLength: size,
+		Body:          sftpBody{f, ctx, func() { stop(); cancel() }},
+		Close:         true,
+		Request:       req,
+	}, nil
+}
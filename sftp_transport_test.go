@@ -0,0 +1,268 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+type SFTPTransportTestSuite struct {
+	MainTestSuite
+
+	dir      string
+	listener net.Listener
+
+	// When stalled is set, the server stops responding until unstall is closed
+	stalled int32
+	unstall chan struct{}
+}
+
+// stallingChannel blocks the server responses when the suite is stalled
+type stallingChannel struct {
+	ssh.Channel
+	s *SFTPTransportTestSuite
+}
+
+func (c stallingChannel) Write(data []byte) (int, error) {
+	if atomic.LoadInt32(&c.s.stalled) == 1 {
+		<-c.s.unstall
+	}
+
+	return c.Channel.Write(data)
+}
+
+func (s *SFTPTransportTestSuite) SetupTest() {
+	s.MainTestSuite.SetupTest()
+
+	dir, err := ioutil.TempDir("", "imgproxy-sftp")
+	require.Nil(s.T(), err)
+	s.dir = dir
+
+	s.stalled = 0
+	s.unstall = make(chan struct{})
+
+	require.Nil(s.T(), os.MkdirAll(filepath.Join(dir, "files", "images"), 0755))
+	require.Nil(s.T(), ioutil.WriteFile(filepath.Join(dir, "files", "images", "logo.png"), []byte("test"), 0644))
+	require.Nil(s.T(), ioutil.WriteFile(filepath.Join(dir, "secret.png"), []byte("secret"), 0644))
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(s.T(), err)
+
+	hostKey, err := ssh.NewSignerFromKey(key)
+	require.Nil(s.T(), err)
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() == "user" && string(pass) == "p@ss" {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("Wrong password for %s", c.User())
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	s.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(s.T(), err)
+
+	go s.serve(config)
+
+	knownHostsPath := filepath.Join(dir, "known_hosts")
+	knownHostsLine := knownhosts.Line([]string{s.listener.Addr().String()}, hostKey.PublicKey())
+	require.Nil(s.T(), ioutil.WriteFile(knownHostsPath, []byte(knownHostsLine+"\n"), 0644))
+
+	conf.SFTPKnownHosts = knownHostsPath
+	conf.SFTPKeys = map[string]string{}
+}
+
+func (s *SFTPTransportTestSuite) TearDownTest() {
+	s.MainTestSuite.TearDownTest()
+
+	s.listener.Close()
+	close(s.unstall)
+	os.RemoveAll(s.dir)
+}
+
+func (s *SFTPTransportTestSuite) serve(config *ssh.ServerConfig) {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			_, chans, reqs, err := ssh.NewServerConn(conn, config)
+			if err != nil {
+				return
+			}
+
+			go ssh.DiscardRequests(reqs)
+
+			for newChannel := range chans {
+				channel, requests, err := newChannel.Accept()
+				if err != nil {
+					return
+				}
+
+				go func() {
+					for req := range requests {
+						req.Reply(req.Type == "subsystem" && string(req.Payload[4:]) == "sftp", nil)
+					}
+				}()
+
+				server, err := sftp.NewServer(stallingChannel{channel, s}, sftp.ReadOnly())
+				if err != nil {
+					return
+				}
+
+				server.Serve()
+				server.Close()
+			}
+		}()
+	}
+}
+
+func (s *SFTPTransportTestSuite) client() *http.Client {
+	transport := &http.Transport{}
+	transport.RegisterProtocol("sftp", newSFTPTransport())
+
+	return &http.Client{Transport: transport}
+}
+
+func (s *SFTPTransportTestSuite) TestRoundTrip() {
+	conf.SFTPServers = map[string]string{
+		"dam": "sftp://user:p%40ss@" + s.listener.Addr().String() + filepath.ToSlash(s.dir) + "/files/",
+	}
+
+	res, err := s.client().Get("sftp://dam/images/logo.png")
+	require.Nil(s.T(), err)
+	defer res.Body.Close()
+
+	body, _ := ioutil.ReadAll(res.Body)
+
+	assert.Equal(s.T(), 200, res.StatusCode)
+	assert.Equal(s.T(), int64(4), res.ContentLength)
+	assert.Equal(s.T(), []byte("test"), body)
+}
+
+func (s *SFTPTransportTestSuite) TestRoundTripNotFound() {
+	conf.SFTPServers = map[string]string{
+		"dam": "sftp://user:p%40ss@" + s.listener.Addr().String() + filepath.ToSlash(s.dir) + "/files",
+	}
+
+	res, err := s.client().Get("sftp://dam/images/missing.png")
+	require.Nil(s.T(), err)
+	res.Body.Close()
+
+	assert.Equal(s.T(), 404, res.StatusCode)
+}
+
+func (s *SFTPTransportTestSuite) TestRoundTripPathTraversal() {
+	conf.SFTPServers = map[string]string{
+		"dam": "sftp://user:p%40ss@" + s.listener.Addr().String() + filepath.ToSlash(s.dir) + "/files",
+	}
+
+	res, err := s.client().Get("sftp://dam/../secret.png")
+	require.Nil(s.T(), err)
+	res.Body.Close()
+
+	assert.Equal(s.T(), 404, res.StatusCode)
+}
+
+func (s *SFTPTransportTestSuite) TestRoundTripWrongPassword() {
+	conf.SFTPServers = map[string]string{
+		"dam": "sftp://user:wrong@" + s.listener.Addr().String() + filepath.ToSlash(s.dir) + "/files",
+	}
+
+	_, err := s.client().Get("sftp://dam/images/logo.png")
+	assert.Error(s.T(), err)
+}
+
+func (s *SFTPTransportTestSuite) TestRoundTripUnknownHostKey() {
+	require.Nil(s.T(), ioutil.WriteFile(conf.SFTPKnownHosts, []byte{}, 0644))
+
+	conf.SFTPServers = map[string]string{
+		"dam": "sftp://user:p%40ss@" + s.listener.Addr().String() + filepath.ToSlash(s.dir) + "/files",
+	}
+
+	_, err := s.client().Get("sftp://dam/images/logo.png")
+	assert.Error(s.T(), err)
+}
+
+func (s *SFTPTransportTestSuite) TestRoundTripUnknownServer() {
+	conf.SFTPServers = map[string]string{}
+
+	_, err := s.client().Get("sftp://unknown/images/logo.png")
+	assert.Error(s.T(), err)
+}
+
+func (s *SFTPTransportTestSuite) TestRoundTripServerNotResponding() {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(s.T(), err)
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	conf.DownloadTimeout = 1
+	conf.SFTPServers = map[string]string{
+		"dam": "sftp://user:p%40ss@" + listener.Addr().String() + filepath.ToSlash(s.dir) + "/files",
+	}
+
+	start := time.Now()
+
+	_, err = s.client().Get("sftp://dam/images/logo.png")
+	assert.Error(s.T(), err)
+	assert.True(s.T(), time.Since(start) < 3*time.Second)
+}
+
+func (s *SFTPTransportTestSuite) TestRoundTripServerStalledDuringRead() {
+	conf.DownloadTimeout = 1
+	conf.SFTPServers = map[string]string{
+		"dam": "sftp://user:p%40ss@" + s.listener.Addr().String() + filepath.ToSlash(s.dir) + "/files",
+	}
+
+	res, err := s.client().Get("sftp://dam/images/logo.png")
+	require.Nil(s.T(), err)
+	defer res.Body.Close()
+
+	atomic.StoreInt32(&s.stalled, 1)
+
+	start := time.Now()
+
+	_, err = ioutil.ReadAll(res.Body)
+	assert.Error(s.T(), err)
+	assert.True(s.T(), time.Since(start) < 3*time.Second)
+}
+
+func (s *SFTPTransportTestSuite) TestFilePath() {
+	assert.Equal(s.T(), "/files/images/logo.png", (&sftpServer{basePath: "/files/"}).filePath("/images/logo.png"))
+	assert.Equal(s.T(), "/files/secret.png", (&sftpServer{basePath: "/files"}).filePath("/../secret.png"))
+	assert.Equal(s.T(), "images/logo.png", (&sftpServer{}).filePath("/images/logo.png"))
+}
+
+func TestSFTPTransport(t *testing.T) {
+	suite.Run(t, new(SFTPTransportTestSuite))
+}
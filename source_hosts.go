@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+type sourceHostConfig struct {
+	MaxSrcDimension  int
+	MaxSrcResolution int
+	MaxGifFrames     int
+	Quality          int
+	TTL              int
+	Headers          map[string]string
+}
+
+type sourceHosts map[string]*sourceHostConfig
+
+func parseSourceHost(h sourceHosts, hostStr string) error {
+	hostStr = strings.Trim(hostStr, " ")
+
+	if len(hostStr) == 0 || strings.HasPrefix(hostStr, "#") {
+		return nil
+	}
+
+	parts := strings.SplitN(hostStr, "=", 2)
+
+	if len(parts) != 2 {
+		return fmt.Errorf("Invalid source host string: %s", hostStr)
+	}
+
+	host := strings.ToLower(strings.Trim(parts[0], " "))
+	if len(host) == 0 {
+		return fmt.Errorf("Empty source host name: %s", hostStr)
+	}
+
+	value := strings.Trim(parts[1], " ")
+	if len(value) == 0 {
+		return fmt.Errorf("Empty source host value: %s", hostStr)
+	}
+
+	hc, ok := h[host]
+	if !ok {
+		hc = &sourceHostConfig{Headers: make(map[string]string)}
+	}
+
+	for len(value) > 0 {
+		var opt string
+
+		if strings.HasPrefix(value, "header:") {
+			// Header value can contain slashes, so the header option takes the rest of the string
+			opt, value = value, ""
+		} else if i := strings.IndexByte(value, '/'); i >= 0 {
+			opt, value = value[:i], value[i+1:]
+		} else {
+			opt, value = value, ""
+		}
+
+		args := strings.Split(opt, ":")
+
+		if len(args) < 2 {
+			return fmt.Errorf("Invalid source host value: %s", hostStr)
+		}
+
+		if err := applySourceHostOption(hc, args[0], args[1:]); err != nil {
+			return fmt.Errorf("Error in source host `%s`: %s", host, err)
+		}
+	}
+
+	h[host] = hc
+
+	return nil
+}
+
+func applySourceHostOption(hc *sourceHostConfig, name string, args []string) error {
+	if name == "header" {
+		if len(args) < 2 || len(args[0]) == 0 {
+			return fmt.Errorf("Invalid header arguments: %v", args)
+		}
+
+		// Header value can contain colons, so we join the rest of arguments back
+		hc.Headers[args[0]] = strings.Join(args[1:], ":")
+
+		return nil
+	}
+
+	if len(args) > 1 {
+		return fmt.Errorf("Invalid %s arguments: %v", name, args)
+	}
+
+	switch name {
+	case "max_src_resolution":
+		if r, err := strconv.ParseFloat(args[0], 64); err == nil && r > 0 {
+			hc.MaxSrcResolution = int(r * 1000000)
+		} else {
+			return fmt.Errorf("Invalid max src resolution: %s", args[0])
+		}
+	case "max_src_dimension":
+		if d, err := strconv.Atoi(args[0]); err == nil && d > 0 {
+			hc.MaxSrcDimension = d
+		} else {
+			return fmt.Errorf("Invalid max src dimension: %s", args[0])
+		}
+	case "max_gif_frames":
+		if f, err := strconv.Atoi(args[0]); err == nil && f > 0 {
+			hc.MaxGifFrames = f
+		} else {
+			return fmt.Errorf("Invalid max gif frames: %s", args[0])
+		}
+	case "quality":
+		if q, err := strconv.Atoi(args[0]); err == nil && q > 0 && q <= 100 {
+			hc.Quality = q
+		} else {
+			return fmt.Errorf("Invalid quality: %s", args[0])
+		}
+	case "ttl":
+		if t, err := strconv.Atoi(args[0]); err == nil && t > 0 {
+			hc.TTL = t
+		} else {
+			return fmt.Errorf("Invalid TTL: %s", args[0])
+		}
+	default:
+		return fmt.Errorf("Unknown source host option: %s", name)
+	}
+
+	return nil
+}
+
+// sourceHostConfigFor returns config for the host of the provided URL.
+// Options that are not overridden for the host are taken from the global config
+func sourceHostConfigFor(imageURL string) *sourceHostConfig {
+	hc := sourceHostConfig{
+		MaxSrcDimension:  conf.MaxSrcDimension,
+		MaxSrcResolution: conf.MaxSrcResolution,
+		MaxGifFrames:     conf.MaxGifFrames,
+		Quality:          conf.Quality,
+		TTL:              conf.TTL,
+	}
+
+	if len(conf.SourceHosts) == 0 || len(imageURL) == 0 {
+		return &hc
+	}
+
+	u, err := url.Parse(imageURL)
+	if err != nil {
+		return &hc
+	}
+
+	o, ok := conf.SourceHosts[strings.ToLower(u.Hostname())]
+	if !ok {
+		return &hc
+	}
+
+	if o.MaxSrcDimension > 0 {
+		hc.MaxSrcDimension = o.MaxSrcDimension
+	}
+	if o.MaxSrcResolution > 0 {
+		hc.MaxSrcResolution = o.MaxSrcResolution
+	}
+	if o.MaxGifFrames > 0 {
+		hc.MaxGifFrames = o.MaxGifFrames
+	}
+	if o.Quality > 0 {
+		hc.Quality = o.Quality
+	}
+	if o.TTL > 0 {
+		hc.TTL = o.TTL
+	}
+
+	hc.Headers = o.Headers
+
+	return &hc
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Number of bytes at the end of the file where ZIP end of central directory record
+// can be found: the record itself and the maximum comment size
+const zipEOCDSearchLen = 22 + 65535
+
+// Number of bytes at the start of the file where PDF readers look for the header
+const pdfHeaderSearchLen = 1024
+
+// Number of bytes at the start and at the end of the file where we look for markup.
+// Browsers sniff the document type at the start of the file, and scripts are usually
+// appended to the end. Compressed image data can contain markup bytes by chance,
+// so we don't search in the middle of the file
+const markupSearchLen = 4096
+
+var (
+	sourceMimes = map[imageType][]string{
+		imageTypeJPEG: {"image/jpeg", "image/jpg", "image/pjpeg"},
+		imageTypePNG:  {"image/png"},
+		imageTypeWEBP: {"image/webp"},
+		imageTypeGIF:  {"image/gif"},
+		imageTypeICO:  {"image/x-icon", "image/vnd.microsoft.icon"},
+		imageTypeSVG:  {"image/svg+xml"},
+	}
+
+	// Content types that don't tell anything about the content
+	genericMimes = []string{"", "application/octet-stream", "binary/octet-stream"}
+
+	// Markup that makes browsers or interpreters treat the file as a document or a script
+	polyglotMarkers = [][]byte{
+		[]byte("<script"),
+		[]byte("<html"),
+		[]byte("<!doctype html"),
+		[]byte("<?php"),
+	}
+
+	errSourceImageTypeMismatch = newError(422, "Source image type doesn't match its content type or extension", "Invalid source image")
+	errSourceImageIsPolyglot   = newError(422, "Source image contains data of another format", "Invalid source image")
+)
+
+// checkSourceTypeMismatch checks that the content type and the extension of the source
+// agree with the detected image type. Generic content types and unknown extensions are ignored
+func checkSourceTypeMismatch(res *http.Response, imgtype imageType) error {
+	contentType, _, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil {
+		contentType = ""
+	}
+
+	contentType = strings.ToLower(contentType)
+
+	if !containsString(genericMimes, contentType) && !containsString(sourceMimes[imgtype], contentType) {
+		return errSourceImageTypeMismatch
+	}
+
+	if res.Request != nil && res.Request.URL != nil {
+		ext := strings.ToLower(strings.TrimPrefix(path.Ext(res.Request.URL.Path), "."))
+
+		if exttype, ok := imageTypes[ext]; ok && exttype != imgtype {
+			return errSourceImageTypeMismatch
+		}
+	}
+
+	return nil
+}
+
+// indexFold is like bytes.Index but ignores ASCII case. Markers should be lowercase
+func indexFold(data, marker []byte) int {
+	for i := 0; i <= len(data)-len(marker); i++ {
+		j := bytes.IndexByte(data[i:len(data)-len(marker)+1], marker[0])
+		if j < 0 {
+			return -1
+		}
+
+		i += j
+
+		if bytes.EqualFold(data[i:i+len(marker)], marker) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// checkPolyglot detects files that are valid images and also can be treated
+// as archives, documents, or scripts
+func checkPolyglot(data []byte) error {
+	tail := data
+	if len(tail) > zipEOCDSearchLen {
+		tail = tail[len(tail)-zipEOCDSearchLen:]
+	}
+
+	if bytes.Contains(tail, []byte("PK\x05\x06")) {
+		return errSourceImageIsPolyglot
+	}
+
+	head := data
+	if len(head) > pdfHeaderSearchLen {
+		head = head[:pdfHeaderSearchLen]
+	}
+
+	if bytes.Contains(head, []byte("%PDF-")) {
+		return errSourceImageIsPolyglot
+	}
+
+	head, tail = data, nil
+	if len(data) > 2*markupSearchLen {
+		head, tail = data[:markupSearchLen], data[len(data)-markupSearchLen:]
+	}
+
+	for _, marker := range polyglotMarkers {
+		if indexFold(head, marker) >= 0 || indexFold(tail, marker) >= 0 {
+			return errSourceImageIsPolyglot
+		}
+	}
+
+	return nil
+}
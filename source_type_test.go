@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type SourceTypeTestSuite struct{ MainTestSuite }
+
+func (s *SourceTypeTestSuite) response(contentType, url string) *http.Response {
+	req, _ := http.NewRequest("GET", url, nil)
+
+	res := &http.Response{Header: make(http.Header), Request: req}
+	res.Header.Set("Content-Type", contentType)
+
+	return res
+}
+
+func (s *SourceTypeTestSuite) TestCheckTypeAndDimensions() {
+	buf := new(bytes.Buffer)
+	require.Nil(s.T(), png.Encode(buf, image.NewGray(image.Rect(0, 0, 4, 2))))
+
+	imgtype, err := checkTypeAndDimensions(buf, &sourceHostConfig{MaxSrcResolution: 100})
+
+	require.Nil(s.T(), err)
+	assert.Equal(s.T(), imageTypePNG, imgtype)
+}
+
+func (s *SourceTypeTestSuite) TestCheckTypeAndDimensionsUnknownContent() {
+	_, err := checkTypeAndDimensions(strings.NewReader("<html><body>"), &sourceHostConfig{MaxSrcResolution: 100})
+
+	assert.Equal(s.T(), errSourceImageTypeNotSupported, err)
+}
+
+func (s *SourceTypeTestSuite) TestReadAndCheckImageNotImage() {
+	res := s.response("image/png", "http://images.dev/lorem.png")
+	res.Body = ioutil.NopCloser(strings.NewReader("<html><body>Not an image</body></html>"))
+
+	_, cancel, err := readAndCheckImage(context.Background(), res, &sourceHostConfig{MaxSrcResolution: 100})
+	defer cancel()
+
+	assert.Equal(s.T(), errSourceImageTypeNotSupported, err)
+}
+
+func (s *SourceTypeTestSuite) TestCheckSourceTypeMismatch() {
+	assert.Nil(s.T(), checkSourceTypeMismatch(s.response("image/png", "http://images.dev/lorem.png"), imageTypePNG))
+	assert.Nil(s.T(), checkSourceTypeMismatch(s.response("IMAGE/JPEG; charset=binary", "http://images.dev/lorem.jpeg"), imageTypeJPEG))
+	assert.Nil(s.T(), checkSourceTypeMismatch(s.response("application/octet-stream", "http://images.dev/lorem"), imageTypeGIF))
+	assert.Nil(s.T(), checkSourceTypeMismatch(s.response("", "http://images.dev/lorem.php"), imageTypeGIF))
+}
+
+func (s *SourceTypeTestSuite) TestCheckSourceTypeMismatchContentType() {
+	assert.Equal(s.T(), errSourceImageTypeMismatch, checkSourceTypeMismatch(s.response("image/png", "http://images.dev/lorem"), imageTypeJPEG))
+	assert.Equal(s.T(), errSourceImageTypeMismatch, checkSourceTypeMismatch(s.response("text/html", "http://images.dev/lorem"), imageTypeJPEG))
+}
+
+func (s *SourceTypeTestSuite) TestCheckSourceTypeMismatchExtension() {
+	assert.Equal(s.T(), errSourceImageTypeMismatch, checkSourceTypeMismatch(s.response("", "http://images.dev/lorem.png"), imageTypeGIF))
+}
+
+func (s *SourceTypeTestSuite) TestCheckPolyglot() {
+	image := append([]byte("GIF89a"), bytes.Repeat([]byte{0}, 2048)...)
+
+	assert.Nil(s.T(), checkPolyglot(image))
+
+	gifar := append(append([]byte{}, image...), []byte("PK\x05\x06\x00\x00\x00\x00")...)
+	assert.Equal(s.T(), errSourceImageIsPolyglot, checkPolyglot(gifar))
+
+	pdf := append([]byte("GIF89a%PDF-1.4"), image...)
+	assert.Equal(s.T(), errSourceImageIsPolyglot, checkPolyglot(pdf))
+
+	html := append(append([]byte{}, image...), []byte("<SCRIPT>alert(1)</SCRIPT>")...)
+	assert.Equal(s.T(), errSourceImageIsPolyglot, checkPolyglot(html))
+}
+
+func (s *SourceTypeTestSuite) TestCheckPolyglotMarkerOutsideSearchArea() {
+	// PDF header matters only at the beginning of the file
+	pdf := append(bytes.Repeat([]byte{0}, 2048), []byte("%PDF-1.4")...)
+
+	assert.Nil(s.T(), checkPolyglot(pdf))
+}
+
+func (s *SourceTypeTestSuite) TestCheckPolyglotMarkupInTheMiddle() {
+	// Compressed image data can contain markup bytes by chance
+	image := append([]byte("GIF89a"), bytes.Repeat([]byte{0}, 3*markupSearchLen)...)
+	copy(image[len(image)/2:], "<html")
+
+	assert.Nil(s.T(), checkPolyglot(image))
+}
+
+func (s *SourceTypeTestSuite) TestCheckPolyglotMarkupAtTheEdges() {
+	image := append([]byte("GIF89a"), bytes.Repeat([]byte{0}, 3*markupSearchLen)...)
+
+	script := append(append([]byte{}, image...), []byte("<script>alert(1)</script>")...)
+	assert.Equal(s.T(), errSourceImageIsPolyglot, checkPolyglot(script))
+
+	html := append([]byte{}, image...)
+	copy(html[100:], "<!DOCTYPE html>")
+	assert.Equal(s.T(), errSourceImageIsPolyglot, checkPolyglot(html))
+}
+
+func (s *SourceTypeTestSuite) TestIndexFold() {
+	assert.Equal(s.T(), 3, indexFold([]byte("abc<HtMl>"), []byte("<html")))
+	assert.Equal(s.T(), 0, indexFold([]byte("<html"), []byte("<html")))
+	assert.Equal(s.T(), -1, indexFold([]byte("<<htm"), []byte("<html")))
+	assert.Equal(s.T(), -1, indexFold([]byte("<h"), []byte("<html")))
+}
+
+func TestSourceType(t *testing.T) {
+	suite.Run(t, new(SourceTypeTestSuite))
+}
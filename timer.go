@@ -32,6 +32,10 @@ func checkTimeout(ctx context.Context) {
 			incrementPrometheusErrorsTotal("timeout")
 		}
 
+		if otlpEnabled {
+			incrementOTLPErrorsTotal("timeout")
+		}
+
 		panic(newError(503, fmt.Sprintf("Timeout after %v", d), "Timeout"))
 	default:
 		// Go ahead
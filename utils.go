@@ -13,3 +13,12 @@ func minInt(a, b int) int {
 	}
 	return b
 }
+
+func containsString(s []string, str string) bool {
+	for _, v := range s {
+		if v == str {
+			return true
+		}
+	}
+	return false
+}
@@ -2,13 +2,29 @@ package main
 
 import (
 	"bytes"
+	"container/list"
 	"context"
 	"encoding/base64"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
 )
 
+type cachedWatermark struct {
+	url     string
+	data    []byte
+	imgtype imageType
+	expires time.Time
+}
+
+var remoteWatermarks = newWatermarksCache()
+
+const msgWatermarkIsUnreachable = "Watermark image is unreachable"
+
 func watermarkData() ([]byte, imageType, context.CancelFunc, error) {
 	if len(conf.WatermarkData) > 0 {
 		data, imgtype, err := base64WatermarkData()
@@ -33,7 +49,7 @@ func base64WatermarkData() ([]byte, imageType, error) {
 		return nil, imageTypeUnknown, fmt.Errorf("Can't decode watermark data: %s", err)
 	}
 
-	imgtype, err := checkTypeAndDimensions(bytes.NewReader(data))
+	imgtype, err := checkTypeAndDimensions(bytes.NewReader(data), sourceHostConfigFor(""))
 	if err != nil {
 		return nil, imageTypeUnknown, fmt.Errorf("Can't decode watermark: %s", err)
 	}
@@ -47,7 +63,7 @@ func fileWatermarkData() ([]byte, imageType, error) {
 		return nil, imageTypeUnknown, fmt.Errorf("Can't read watermark: %s", err)
 	}
 
-	imgtype, err := checkTypeAndDimensions(f)
+	imgtype, err := checkTypeAndDimensions(f, sourceHostConfigFor(""))
 	if err != nil {
 		return nil, imageTypeUnknown, fmt.Errorf("Can't decode watermark: %s", err)
 	}
@@ -73,3 +89,114 @@ func remoteWatermarkData() ([]byte, imageType, context.CancelFunc, error) {
 
 	return getImageData(ctx).Bytes(), getImageType(ctx), cancel, err
 }
+
+// watermarksCache is an LRU cache of the watermarks specified with the watermark_url
+// processing option. Concurrent misses for the same URL share a single download
+type watermarksCache struct {
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+
+	group singleflight.Group
+}
+
+func newWatermarksCache() *watermarksCache {
+	return &watermarksCache{
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (c *watermarksCache) get(url string) (*cachedWatermark, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	elem, ok := c.entries[url]
+	if !ok {
+		return nil, false
+	}
+
+	cached := elem.Value.(*cachedWatermark)
+
+	if time.Now().After(cached.expires) {
+		c.lru.Remove(elem)
+		delete(c.entries, url)
+		return nil, false
+	}
+
+	c.lru.MoveToFront(elem)
+
+	return cached, true
+}
+
+func (c *watermarksCache) set(cached *cachedWatermark) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if elem, ok := c.entries[cached.url]; ok {
+		elem.Value = cached
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.entries[cached.url] = c.lru.PushFront(cached)
+
+	for c.lru.Len() > conf.WatermarkCacheSize {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedWatermark).url)
+	}
+}
+
+func (c *watermarksCache) len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.lru.Len()
+}
+
+func downloadWatermark(url string) (*cachedWatermark, error) {
+	// Download is shared between requests, so it shouldn't depend on any of their contexts
+	ctx, cancel, err := downloadImage(context.WithValue(context.Background(), imageURLCtxKey, url))
+	defer cancel()
+
+	if err != nil {
+		return nil, newError(404, fmt.Sprintf("Can't download watermark: %s", err), msgWatermarkIsUnreachable)
+	}
+
+	// Downloaded data is stored in a pooled buffer, so we need to copy it before caching
+	buf := getImageData(ctx)
+	data := make([]byte, buf.Len())
+	copy(data, buf.Bytes())
+
+	return &cachedWatermark{
+		url:     url,
+		data:    data,
+		imgtype: getImageType(ctx),
+		expires: time.Now().Add(time.Duration(conf.WatermarkCacheTTL) * time.Second),
+	}, nil
+}
+
+func cachedRemoteWatermarkData(url string) ([]byte, imageType, error) {
+	if cached, ok := remoteWatermarks.get(url); ok {
+		return cached.data, cached.imgtype, nil
+	}
+
+	v, err, _ := remoteWatermarks.group.Do(url, func() (interface{}, error) {
+		cached, err := downloadWatermark(url)
+
+		if err == nil && conf.WatermarkCacheTTL > 0 {
+			remoteWatermarks.set(cached)
+		}
+
+		return cached, err
+	})
+
+	if err != nil {
+		return nil, imageTypeUnknown, err
+	}
+
+	cached := v.(*cachedWatermark)
+
+	return cached.data, cached.imgtype, nil
+}
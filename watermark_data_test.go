@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type WatermarkDataTestSuite struct {
+	MainTestSuite
+
+	server    *httptest.Server
+	downloads int32
+	release   chan struct{}
+}
+
+func (s *WatermarkDataTestSuite) SetupSuite() {
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 1, 1)))
+	data := buf.Bytes()
+
+	s.server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&s.downloads, 1)
+
+		if s.release != nil {
+			<-s.release
+		}
+
+		rw.Header().Set("Content-Type", "image/png")
+		rw.Write(data)
+	}))
+}
+
+func (s *WatermarkDataTestSuite) TearDownSuite() {
+	s.server.Close()
+}
+
+func (s *WatermarkDataTestSuite) SetupTest() {
+	s.MainTestSuite.SetupTest()
+
+	atomic.StoreInt32(&s.downloads, 0)
+	s.release = nil
+
+	remoteWatermarks = newWatermarksCache()
+}
+
+func (s *WatermarkDataTestSuite) url(name string) string {
+	return fmt.Sprintf("%s/%s.png", s.server.URL, name)
+}
+
+func (s *WatermarkDataTestSuite) TestCacheHit() {
+	for i := 0; i < 2; i++ {
+		_, imgtype, err := cachedRemoteWatermarkData(s.url("wm"))
+
+		require.Nil(s.T(), err)
+		assert.Equal(s.T(), imageTypePNG, imgtype)
+	}
+
+	assert.Equal(s.T(), int32(1), atomic.LoadInt32(&s.downloads))
+}
+
+func (s *WatermarkDataTestSuite) TestCacheExpired() {
+	_, _, err := cachedRemoteWatermarkData(s.url("wm"))
+	require.Nil(s.T(), err)
+
+	remoteWatermarks.entries[s.url("wm")].Value.(*cachedWatermark).expires = time.Now().Add(-time.Second)
+
+	_, _, err = cachedRemoteWatermarkData(s.url("wm"))
+	require.Nil(s.T(), err)
+
+	assert.Equal(s.T(), int32(2), atomic.LoadInt32(&s.downloads))
+}
+
+func (s *WatermarkDataTestSuite) TestCacheDisabled() {
+	conf.WatermarkCacheTTL = 0
+
+	for i := 0; i < 2; i++ {
+		_, _, err := cachedRemoteWatermarkData(s.url("wm"))
+		require.Nil(s.T(), err)
+	}
+
+	assert.Equal(s.T(), int32(2), atomic.LoadInt32(&s.downloads))
+	assert.Equal(s.T(), 0, remoteWatermarks.len())
+}
+
+func (s *WatermarkDataTestSuite) TestCacheSize() {
+	conf.WatermarkCacheSize = 2
+
+	for _, name := range []string{"wm1", "wm2", "wm1", "wm3"} {
+		_, _, err := cachedRemoteWatermarkData(s.url(name))
+		require.Nil(s.T(), err)
+	}
+
+	assert.Equal(s.T(), 2, remoteWatermarks.len())
+
+	_, ok := remoteWatermarks.get(s.url("wm1"))
+	assert.True(s.T(), ok)
+
+	_, ok = remoteWatermarks.get(s.url("wm2"))
+	assert.False(s.T(), ok)
+
+	_, ok = remoteWatermarks.get(s.url("wm3"))
+	assert.True(s.T(), ok)
+}
+
+func (s *WatermarkDataTestSuite) TestConcurrentMisses() {
+	s.release = make(chan struct{})
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			_, _, err := cachedRemoteWatermarkData(s.url("wm"))
+			assert.Nil(s.T(), err)
+		}()
+	}
+
+	// Let all the goroutines join the download before it finishes
+	time.Sleep(50 * time.Millisecond)
+	close(s.release)
+
+	wg.Wait()
+
+	assert.Equal(s.T(), int32(1), atomic.LoadInt32(&s.downloads))
+}
+
+func (s *WatermarkDataTestSuite) TestDownloadError() {
+	_, _, err := cachedRemoteWatermarkData("http://127.0.0.1:1/wm.png")
+
+	require.NotNil(s.T(), err)
+	assert.Equal(s.T(), msgWatermarkIsUnreachable, err.(*imgproxyError).PublicMessage)
+	assert.Equal(s.T(), 0, remoteWatermarks.len())
+}
+
+func TestWatermarkData(t *testing.T) {
+	suite.Run(t, new(WatermarkDataTestSuite))
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// webdavTransport implements RoundTripper for the 'webdav' protocol.
+// The host of the requested URL is the name of the server defined in config,
+// so credentials are never exposed in image URLs
+type webdavTransport struct {
+	transport http.RoundTripper
+	servers   map[string]*url.URL
+}
+
+func newWebDAVTransport(transport http.RoundTripper) http.RoundTripper {
+	servers := make(map[string]*url.URL)
+
+	for name, server := range conf.WebDAVServers {
+		// Server URLs are checked during config initialization
+		u, _ := url.Parse(server)
+		servers[name] = u
+	}
+
+	return webdavTransport{transport, servers}
+}
+
+func (t webdavTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	server, ok := t.servers[req.URL.Host]
+	if !ok {
+		return nil, fmt.Errorf("Unknown WebDAV server: %s", req.URL.Host)
+	}
+
+	u := *server
+	u.User = nil
+	u.Path = strings.TrimSuffix(u.Path, "/") + path.Clean("/"+req.URL.Path)
+	u.RawPath = ""
+	u.RawQuery = req.URL.RawQuery
+
+	davReq, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	davReq = davReq.WithContext(req.Context())
+
+	for k, v := range req.Header {
+		davReq.Header[k] = v
+	}
+
+	if server.User != nil {
+		password, _ := server.User.Password()
+		davReq.SetBasicAuth(server.User.Username(), password)
+	}
+
+	return t.transport.RoundTrip(davReq)
+}
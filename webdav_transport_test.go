@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type WebDAVTransportTestSuite struct{ MainTestSuite }
+
+func (s *WebDAVTransportTestSuite) TestRoundTrip() {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+
+		assert.True(s.T(), ok)
+		assert.Equal(s.T(), "user", user)
+		assert.Equal(s.T(), "p@ss", password)
+		assert.Equal(s.T(), "/dav/images/logo.png", r.URL.Path)
+
+		rw.Write([]byte("test"))
+	}))
+	defer server.Close()
+
+	conf.WebDAVServers = map[string]string{
+		"dam": "http://user:p%40ss@" + server.Listener.Addr().String() + "/dav/",
+	}
+
+	transport := &http.Transport{}
+	transport.RegisterProtocol("webdav", newWebDAVTransport(transport))
+
+	client := &http.Client{Transport: transport}
+
+	res, err := client.Get("webdav://dam/images/logo.png")
+	require.Nil(s.T(), err)
+	defer res.Body.Close()
+
+	body, _ := ioutil.ReadAll(res.Body)
+
+	assert.Equal(s.T(), 200, res.StatusCode)
+	assert.Equal(s.T(), []byte("test"), body)
+}
+
+func (s *WebDAVTransportTestSuite) TestRoundTripPathTraversal() {
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		assert.Equal(s.T(), "/dav/secret.png", r.URL.Path)
+	}))
+	defer server.Close()
+
+	conf.WebDAVServers = map[string]string{
+		"dam": server.URL + "/dav",
+	}
+
+	transport := &http.Transport{}
+	transport.RegisterProtocol("webdav", newWebDAVTransport(transport))
+
+	res, err := (&http.Client{Transport: transport}).Get("webdav://dam/../secret.png")
+	require.Nil(s.T(), err)
+	res.Body.Close()
+}
+
+func (s *WebDAVTransportTestSuite) TestRoundTripUnknownServer() {
+	conf.WebDAVServers = map[string]string{}
+
+	transport := &http.Transport{}
+	transport.RegisterProtocol("webdav", newWebDAVTransport(transport))
+
+	_, err := (&http.Client{Transport: transport}).Get("webdav://unknown/images/logo.png")
+	assert.Error(s.T(), err)
+}
+
+func TestWebDAVTransport(t *testing.T) {
+	suite.Run(t, new(WebDAVTransportTestSuite))
+}